@@ -18,6 +18,7 @@ struct giflib_decoder_struct {
     uint8_t bg_red;
     uint8_t bg_blue;
     uint8_t bg_alpha;
+    int warnings;
     bool have_read_first_frame;
     bool seek_clear_extensions;
 };
@@ -49,6 +50,22 @@ struct giflib_encoder_struct {
 
     int prev_frame_disposal;
 
+    // disposal method forced onto every frame, or -1 to keep the input's
+    int disposal_override;
+
+    // write a gif87a, which has no extension blocks
+    bool gif87;
+
+    // crop each frame to the area that changed since the previous one
+    bool optimize_bounds;
+
+    // a color added to every palette that lacks it
+    bool have_palette_color;
+    GifColorType palette_color;
+
+    // leave the input's XMP packet out of the output
+    bool strip_xmp;
+
     uint8_t* prev_frame_bgra;
 
     bool have_written_first_frame;
@@ -77,6 +94,22 @@ opencv_mat opencv_mat_create_from_data(int width, int height, int type, void* da
     return mat;
 }
 
+opencv_mat opencv_mat_create_from_data_with_stride(int width,
+                                                int height,
+                                                int type,
+                                                void* data,
+                                                size_t data_len,
+                                                size_t stride)
+{
+    size_t row_size = width * CV_ELEM_SIZE(type);
+    if (stride < row_size || (height - 1) * stride + row_size > data_len) {
+        return NULL;
+    }
+    auto mat = new cv::Mat(height, width, type, data, stride);
+    mat->datalimit = (uint8_t*)data + data_len;
+    return mat;
+}
+
 opencv_mat opencv_mat_crop(const opencv_mat src, int x, int y, int width, int height)
 {
     auto ret = new cv::Mat;
@@ -84,6 +117,45 @@ opencv_mat opencv_mat_crop(const opencv_mat src, int x, int y, int width, int he
     return ret;
 }
 
+void opencv_mat_copy(const opencv_mat src, opencv_mat dst)
+{
+    static_cast<const cv::Mat*>(src)->copyTo(*static_cast<cv::Mat*>(dst));
+}
+
+// orientation takes the values of the exif/tiff orientation tag
+void opencv_mat_orientation_transform(int orientation, const opencv_mat src, opencv_mat dst)
+{
+    auto in = static_cast<const cv::Mat*>(src);
+    auto out = static_cast<cv::Mat*>(dst);
+    switch (orientation) {
+    case 2: // top right
+        cv::flip(*in, *out, 1);
+        break;
+    case 3: // bottom right
+        cv::flip(*in, *out, -1);
+        break;
+    case 4: // bottom left
+        cv::flip(*in, *out, 0);
+        break;
+    case 5: // left top
+        cv::transpose(*in, *out);
+        break;
+    case 6: // right top
+        cv::rotate(*in, *out, cv::ROTATE_90_CLOCKWISE);
+        break;
+    case 7: // right bottom
+        cv::transpose(*in, *out);
+        cv::flip(*out, *out, -1);
+        break;
+    case 8: // left bottom
+        cv::rotate(*in, *out, cv::ROTATE_90_COUNTERCLOCKWISE);
+        break;
+    default: // top left, or unknown
+        in->copyTo(*out);
+        break;
+    }
+}
+
 void opencv_mat_resize(const opencv_mat src,
                        opencv_mat dst,
                        int width,
@@ -109,6 +181,21 @@ int opencv_type_depth(int type)
     return CV_ELEM_SIZE1(type) * 8;
 }
 
+int opencv_type_elem_size(int type)
+{
+    return CV_ELEM_SIZE(type);
+}
+
+int opencv_get_num_threads()
+{
+    return cv::getNumThreads();
+}
+
+void opencv_set_num_threads(int n)
+{
+    cv::setNumThreads(n);
+}
+
 int opencv_type_convert_depth(int t, int depth)
 {
     return CV_MAKETYPE(depth, CV_MAT_CN(t));
@@ -171,6 +258,23 @@ int giflib_decoder_get_prev_frame_delay(const giflib_decoder d)
     return d->prev_frame_delay_time;
 }
 
+int giflib_decoder_get_warnings(const giflib_decoder d)
+{
+    return d->warnings;
+}
+
+// returns the global palette's background color packed as 0xRRGGBB,
+// or -1 if the gif has no global palette to look it up in
+int giflib_decoder_get_background_color(const giflib_decoder d)
+{
+    ColorMapObject* colorMap = d->gif->SColorMap;
+    if (!colorMap || !colorMap->Colors || d->gif->SBackGroundColor >= colorMap->ColorCount) {
+        return -1;
+    }
+    GifColorType c = colorMap->Colors[d->gif->SBackGroundColor];
+    return (c.Red << 16) | (c.Green << 8) | c.Blue;
+}
+
 void giflib_decoder_release(giflib_decoder d)
 {
     if (d->pixels) {
@@ -343,6 +447,11 @@ static bool giflib_decoder_render_frame(giflib_decoder d, GraphicsControlBlock*
     int skip_bottom =
       (frame_top + frame_height > buf_height) ? (frame_top + frame_height - buf_height) : 0;
 
+    if (skip_left || skip_top || skip_right || skip_bottom) {
+        // we can still render the visible part, but the image is malformed
+        d->warnings |= giflib_decoder_warning_frame_out_of_bounds;
+    }
+
     ColorMapObject* globalColorMap = d->gif->SColorMap;
     ColorMapObject* frameColorMap = desc.ColorMap;
     ColorMapObject* colorMap = frameColorMap ? frameColorMap : globalColorMap;
@@ -466,6 +575,12 @@ static bool giflib_decoder_render_frame(giflib_decoder d, GraphicsControlBlock*
                 dst += 4;
                 continue;
             }
+            if (palette_index >= colorMap->ColorCount) {
+                // there is no color to draw, so leave this pixel untouched
+                d->warnings |= giflib_decoder_warning_palette_index_out_of_range;
+                dst += 4;
+                continue;
+            }
             *dst++ = colorMap->Colors[palette_index].Blue;
             *dst++ = colorMap->Colors[palette_index].Green;
             *dst++ = colorMap->Colors[palette_index].Red;
@@ -672,6 +787,7 @@ giflib_encoder giflib_encoder_create(void* buf, size_t buf_len)
     memset(e, 0, sizeof(struct giflib_encoder_struct));
     e->dst = (uint8_t*)(buf);
     e->dst_len = buf_len;
+    e->disposal_override = -1;
 
     int error = 0;
     GifFileType* gif_out = EGifOpen(e, encode_func, &error);
@@ -691,11 +807,80 @@ giflib_encoder giflib_encoder_create(void* buf, size_t buf_len)
     return e;
 }
 
+void giflib_encoder_set_disposal(giflib_encoder e, int disposal)
+{
+    e->disposal_override = disposal;
+}
+
+void giflib_encoder_set_gif87(giflib_encoder e, bool gif87)
+{
+    e->gif87 = gif87;
+}
+
+void giflib_encoder_set_optimize_bounds(giflib_encoder e, bool optimize_bounds)
+{
+    e->optimize_bounds = optimize_bounds;
+}
+
+void giflib_encoder_set_strip_xmp(giflib_encoder e, bool strip_xmp)
+{
+    e->strip_xmp = strip_xmp;
+}
+
+void giflib_encoder_add_palette_color(giflib_encoder e, int r, int g, int b)
+{
+    e->have_palette_color = true;
+    e->palette_color.Red = r;
+    e->palette_color.Green = g;
+    e->palette_color.Blue = b;
+}
+
+// add the palette color, if any, to map when it is missing. d's current frame
+// tells us which entry is transparent and so can't stand in for the color.
+// a full palette is left alone, and the color is matched to its nearest entry
+static void giflib_encoder_extend_color_map(giflib_encoder e,
+                                            const giflib_decoder d,
+                                            ColorMapObject* map)
+{
+    if (!e->have_palette_color || !map) {
+        return;
+    }
+
+    GraphicsControlBlock gcb;
+    giflib_get_frame_gcb(d->gif, &gcb);
+
+    const GifColorType& c = e->palette_color;
+    for (int i = 0; i < map->ColorCount; i++) {
+        if (i == gcb.TransparentColor) {
+            continue;
+        }
+        const GifColorType& entry = map->Colors[i];
+        if (entry.Red == c.Red && entry.Green == c.Green && entry.Blue == c.Blue) {
+            return;
+        }
+    }
+
+    if (map->ColorCount >= 256) {
+        return;
+    }
+
+    // gif palettes hold a power of two entries, so double it and pad with black
+    int count = map->ColorCount * 2;
+    GifColorType* colors = giflib_encoder_allocate_colors(e, count);
+    memset(colors, 0, count * sizeof(GifColorType));
+    memmove(colors, map->Colors, map->ColorCount * sizeof(GifColorType));
+    colors[map->ColorCount] = c;
+    map->Colors = colors;
+    map->ColorCount = count;
+    map->BitsPerPixel++;
+}
+
 // this function should be called just once when we know the global dimensions
 bool giflib_encoder_init(giflib_encoder e, const giflib_decoder d, int width, int height)
 {
-    // all gifs will output as gif89
-    EGifSetGifVersion(e->gif, true);
+    // gifs output as gif89 unless the caller has established that the
+    // image needs none of its extensions
+    EGifSetGifVersion(e->gif, !e->gif87);
     e->gif->SWidth = width;
     e->gif->SHeight = height;
 
@@ -714,6 +899,7 @@ bool giflib_encoder_init(giflib_encoder e, const giflib_decoder d, int width, in
         memmove(e->gif->SColorMap->Colors,
                 d->gif->SColorMap->Colors,
                 e->gif->SColorMap->ColorCount * sizeof(GifColorType));
+        giflib_encoder_extend_color_map(e, d, e->gif->SColorMap);
     }
 
     int res = EGifPutScreenDesc(e->gif,
@@ -729,6 +915,71 @@ bool giflib_encoder_init(giflib_encoder e, const giflib_decoder d, int width, in
     return true;
 }
 
+// write profile as an ICCRGBG1012 application extension. this should be
+// called after giflib_encoder_init and before the first frame is encoded
+bool giflib_encoder_write_icc_profile(giflib_encoder e, const void* profile, size_t profile_len)
+{
+    static const GifByteType app_id[] = "ICCRGBG1012";
+
+    if (EGifPutExtensionLeader(e->gif, APPLICATION_EXT_FUNC_CODE) == GIF_ERROR) {
+        return false;
+    }
+
+    if (EGifPutExtensionBlock(e->gif, sizeof(app_id) - 1, app_id) == GIF_ERROR) {
+        return false;
+    }
+
+    const GifByteType* data = static_cast<const GifByteType*>(profile);
+    while (profile_len > 0) {
+        int chunk_len = (profile_len > 255) ? 255 : profile_len;
+        if (EGifPutExtensionBlock(e->gif, chunk_len, data) == GIF_ERROR) {
+            return false;
+        }
+        data += chunk_len;
+        profile_len -= chunk_len;
+    }
+
+    return EGifPutExtensionTrailer(e->gif) != GIF_ERROR;
+}
+
+// whether b begins the application extension holding an XMP packet
+static bool giflib_is_xmp_extension(const ExtensionBlock* b)
+{
+    static const char xmp_id[] = "XMP DataXMP";
+    return b->Function == APPLICATION_EXT_FUNC_CODE && b->ByteCount == sizeof(xmp_id) - 1 &&
+      memcmp(b->Bytes, xmp_id, sizeof(xmp_id) - 1) == 0;
+}
+
+// copy the extension blocks d has read to the output, leaving out the XMP
+// packet and its continuation blocks if it is being stripped
+static void giflib_encoder_copy_extensions(giflib_encoder e, const giflib_decoder d)
+{
+    e->gif->ExtensionBlockCount = 0;
+    e->gif->ExtensionBlocks = NULL;
+    if (d->gif->ExtensionBlockCount == 0) {
+        return;
+    }
+
+    e->gif->ExtensionBlocks =
+      giflib_encoder_allocate_extension_blocks(e, d->gif->ExtensionBlockCount);
+    bool skipping = false;
+    for (int i = 0; i < d->gif->ExtensionBlockCount; i++) {
+        ExtensionBlock* eb_in = &(d->gif->ExtensionBlocks[i]);
+        if (eb_in->Function != CONTINUE_EXT_FUNC_CODE) {
+            skipping = e->strip_xmp && giflib_is_xmp_extension(eb_in);
+        }
+        if (skipping) {
+            continue;
+        }
+
+        ExtensionBlock* eb_out = &(e->gif->ExtensionBlocks[e->gif->ExtensionBlockCount++]);
+        eb_out->ByteCount = eb_in->ByteCount;
+        eb_out->Function = eb_in->Function;
+        eb_out->Bytes = giflib_encoder_allocate_gif_bytes(e, eb_out->ByteCount);
+        memmove(eb_out->Bytes, eb_in->Bytes, eb_out->ByteCount);
+    }
+}
+
 static bool giflib_encoder_setup_frame(giflib_encoder e, const giflib_decoder d)
 {
     // initialize frame with input gif's frame metadata
@@ -752,26 +1003,42 @@ static bool giflib_encoder_setup_frame(giflib_encoder e, const giflib_decoder d)
         memmove(e->frame_color_map->Colors,
                 im_in->ColorMap->Colors,
                 e->frame_color_map->ColorCount * sizeof(GifColorType));
+        giflib_encoder_extend_color_map(e, d, e->frame_color_map);
     }
 
     // copy extension blocks specific to this frame
     // this sets up the frame delay as well as which palette entry is transparent, if any
-    e->gif->ExtensionBlockCount = d->gif->ExtensionBlockCount;
-    e->gif->ExtensionBlocks = NULL;
-    if (e->gif->ExtensionBlockCount > 0) {
-        // TODO here and in global extension blocks, we should filter out worthless blocks
-        // we're only really interested in ExtensionBlock.Function = GRAPHICS_EXT_FUNC_CODE
-        // other values like COMMENT_ and PLAINTEXT_ are not essential to viewing the image
-        e->gif->ExtensionBlocks =
-          giflib_encoder_allocate_extension_blocks(e, e->gif->ExtensionBlockCount);
+    // TODO here and in global extension blocks, we should filter out worthless blocks
+    // we're only really interested in ExtensionBlock.Function = GRAPHICS_EXT_FUNC_CODE
+    // other values like COMMENT_ and PLAINTEXT_ are not essential to viewing the image
+    giflib_encoder_copy_extensions(e, d);
+
+    if (e->disposal_override >= 0) {
+        bool have_gcb = false;
         for (int i = 0; i < e->gif->ExtensionBlockCount; i++) {
-            ExtensionBlock* eb_in = &(d->gif->ExtensionBlocks[i]);
-            ExtensionBlock* eb_out = &(e->gif->ExtensionBlocks[i]);
-            eb_out->ByteCount = eb_in->ByteCount;
-            eb_out->Function = eb_in->Function;
-            eb_out->Bytes = giflib_encoder_allocate_gif_bytes(e, eb_out->ByteCount);
-            memmove(eb_out->Bytes, eb_in->Bytes, eb_out->ByteCount);
+            have_gcb |= e->gif->ExtensionBlocks[i].Function == GRAPHICS_EXT_FUNC_CODE;
         }
+
+        if (!have_gcb) {
+            // the input frame had no graphics control block, so give it an
+            // empty one that we can set the disposal method on
+            int count = e->gif->ExtensionBlockCount;
+            ExtensionBlock* blocks = giflib_encoder_allocate_extension_blocks(e, count + 1);
+            if (count > 0) {
+                memmove(blocks, e->gif->ExtensionBlocks, count * sizeof(ExtensionBlock));
+            }
+            blocks[count].Function = GRAPHICS_EXT_FUNC_CODE;
+            blocks[count].ByteCount = 4;
+            blocks[count].Bytes = giflib_encoder_allocate_gif_bytes(e, 4);
+            memset(blocks[count].Bytes, 0, 4);
+            e->gif->ExtensionBlocks = blocks;
+            e->gif->ExtensionBlockCount = count + 1;
+        }
+
+        GraphicsControlBlock gcb;
+        giflib_get_frame_gcb(e->gif, &gcb);
+        gcb.DisposalMode = e->disposal_override;
+        giflib_set_frame_gcb(e->gif, &gcb);
     }
 
     return true;
@@ -789,6 +1056,40 @@ static inline int rgb_distance(int r0, int g0, int b0, int r1, int g1, int b1)
     return dist;
 }
 
+// find the smallest rectangle of frame that differs from the previous frame.
+// returns false if no pixel changed
+static bool giflib_encoder_changed_bounds(giflib_encoder e,
+                                          const cv::Mat* frame,
+                                          int* left,
+                                          int* top,
+                                          int* width,
+                                          int* height)
+{
+    int min_x = frame->cols, min_y = frame->rows, max_x = -1, max_y = -1;
+    for (int y = 0; y < frame->rows; y++) {
+        const uint32_t* src = (const uint32_t*)(frame->data + y * frame->step);
+        const uint32_t* prev = (const uint32_t*)(e->prev_frame_bgra) + y * e->gif->SWidth;
+        for (int x = 0; x < frame->cols; x++) {
+            if (src[x] != prev[x]) {
+                min_x = std::min(min_x, x);
+                max_x = std::max(max_x, x);
+                min_y = std::min(min_y, y);
+                max_y = y;
+            }
+        }
+    }
+
+    if (max_x < 0) {
+        return false;
+    }
+
+    *left = min_x;
+    *top = min_y;
+    *width = max_x - min_x + 1;
+    *height = max_y - min_y + 1;
+    return true;
+}
+
 static bool giflib_encoder_render_frame(giflib_encoder e,
                                         const giflib_decoder d,
                                         const opencv_mat opaque_frame)
@@ -809,7 +1110,6 @@ static bool giflib_encoder_render_frame(giflib_encoder e,
     }
 
     GifImageDesc* im_out = &gif_out->Image;
-    // TODO some day consider making partial frames/make these not 0
     im_out->Left = 0;
     im_out->Top = 0;
     im_out->Width = frame->cols;
@@ -859,6 +1159,25 @@ static bool giflib_encoder_render_frame(giflib_encoder e,
     bool prev_frame_valid = e->have_written_first_frame &&
       (e->prev_frame_disposal == DISPOSAL_UNSPECIFIED || e->prev_frame_disposal == DISPOSE_DO_NOT);
 
+    // the previous frame stays on the canvas, so only the area that changed
+    // needs to be drawn. a frame with no changes still needs a pixel. this
+    // frame must stay on the canvas too, since disposing of a cropped frame
+    // would only clear the cropped area
+    bool frame_persists =
+      gcb.DisposalMode == DISPOSAL_UNSPECIFIED || gcb.DisposalMode == DISPOSE_DO_NOT;
+    if (e->optimize_bounds && prev_frame_valid && frame_persists &&
+        frame->cols == gif_out->SWidth && frame->rows == gif_out->SHeight) {
+        int left, top, width, height;
+        if (!giflib_encoder_changed_bounds(e, frame, &left, &top, &width, &height)) {
+            left = top = 0;
+            width = height = 1;
+        }
+        im_out->Left = left;
+        im_out->Top = top;
+        im_out->Width = width;
+        im_out->Height = height;
+    }
+
     // convenience names for these dimensions
     int frame_left = im_out->Left;
     int frame_top = im_out->Top;
@@ -1000,9 +1319,12 @@ bool giflib_encoder_encode_frame(giflib_encoder e,
     int frame_height = im_out->Height;
     int frame_width = im_out->Width;
 
-    int res = giflib_encoder_write_extensions(e);
-    if (res == GIF_ERROR) {
-        return false;
+    int res;
+    if (!e->gif87) {
+        res = giflib_encoder_write_extensions(e);
+        if (res == GIF_ERROR) {
+            return false;
+        }
     }
 
     res = EGifPutImageDesc(e->gif,
@@ -1049,23 +1371,13 @@ bool giflib_encoder_flush(giflib_encoder e, const giflib_decoder d)
 
     // set up "trailing" extension blocks, which appear after all the frames
     // brian note: what do these do? do we actually need them?
-    e->gif->ExtensionBlockCount = d->gif->ExtensionBlockCount;
-    e->gif->ExtensionBlocks = NULL;
-    if (e->gif->ExtensionBlockCount > 0) {
-        e->gif->ExtensionBlocks =
-          giflib_encoder_allocate_extension_blocks(e, e->gif->ExtensionBlockCount);
-        for (int i = 0; i < e->gif->ExtensionBlockCount; i++) {
-            ExtensionBlock* eb = &(e->gif->ExtensionBlocks[i]);
-            eb->ByteCount = d->gif->ExtensionBlocks[i].ByteCount;
-            eb->Function = d->gif->ExtensionBlocks[i].Function;
-            eb->Bytes = giflib_encoder_allocate_gif_bytes(e, eb->ByteCount);
-            memmove(eb->Bytes, d->gif->ExtensionBlocks[i].Bytes, eb->ByteCount);
-        }
-    }
+    giflib_encoder_copy_extensions(e, d);
 
-    int res = giflib_encoder_write_extensions(e);
-    if (res == GIF_ERROR) {
-        return false;
+    if (!e->gif87) {
+        int res = giflib_encoder_write_extensions(e);
+        if (res == GIF_ERROR) {
+            return false;
+        }
     }
 
     if (EGifCloseFile(e->gif, NULL) == GIF_ERROR) {
@@ -9,7 +9,10 @@ import "C"
 import (
 	"bytes"
 	"errors"
+	"image"
+	"image/color"
 	"io"
+	"sync"
 	"sync/atomic"
 	"time"
 	"unsafe"
@@ -22,6 +25,9 @@ var (
 	ErrFrameBufNoPixels = errors.New("Framebuffer contains no pixels")
 	ErrSkipNotSupported = errors.New("skip operation not supported by this decoder")
 
+	ErrInvalidAspectRatio = errors.New("aspect ratio must be positive")
+	ErrInvalidStride      = errors.New("stride is shorter than a row of pixels")
+
 	gif87Magic   = []byte("GIF87a")
 	gif89Magic   = []byte("GIF89a")
 	mp42Magic    = []byte("ftypmp42")
@@ -36,16 +42,6 @@ func (p PixelType) Depth() int {
 }
 
 const (
-	// Not available since we don't have defined value from C
-	// OrientationTopLeft     = ImageOrientation(C.CV_IMAGE_ORIENTATION_TL)
-	// OrientationTopRight    = ImageOrientation(C.CV_IMAGE_ORIENTATION_TR)
-	// OrientationBottomRight = ImageOrientation(C.CV_IMAGE_ORIENTATION_BR)
-	// OrientationBottomLeft  = ImageOrientation(C.CV_IMAGE_ORIENTATION_BL)
-	// OrientationLeftTop     = ImageOrientation(C.CV_IMAGE_ORIENTATION_LT)
-	// OrientationRightTop    = ImageOrientation(C.CV_IMAGE_ORIENTATION_RT)
-	// OrientationRightBottom = ImageOrientation(C.CV_IMAGE_ORIENTATION_RB)
-	// OrientationLeftBottom  = ImageOrientation(C.CV_IMAGE_ORIENTATION_LB)
-
 	pngChunkSizeFieldLen = 4
 	pngChunkTypeFieldLen = 4
 	pngChunkAllFieldsLen = 12
@@ -57,8 +53,27 @@ var (
 	pngFdatChunkType = []byte{0x66, 0x64, 0x41, 0x54}
 )
 
+// ImageOrientation describes where the first row and column of stored pixels
+// appear when the image is displayed. Values match the EXIF/TIFF
+// orientation tag.
 type ImageOrientation int
 
+const (
+	OrientationTopLeft     ImageOrientation = 1
+	OrientationTopRight    ImageOrientation = 2
+	OrientationBottomRight ImageOrientation = 3
+	OrientationBottomLeft  ImageOrientation = 4
+	OrientationLeftTop     ImageOrientation = 5
+	OrientationRightTop    ImageOrientation = 6
+	OrientationRightBottom ImageOrientation = 7
+	OrientationLeftBottom  ImageOrientation = 8
+)
+
+// transposes reports whether undoing the orientation swaps width and height
+func (o ImageOrientation) transposes() bool {
+	return o >= OrientationLeftTop && o <= OrientationLeftBottom
+}
+
 type ImageHeader struct {
 	width     int
 	height    int
@@ -129,6 +144,115 @@ func (f *Framebuffer) Clear() {
 	C.memset(unsafe.Pointer(&f.buf[0]), 0, C.size_t(len(f.buf)))
 }
 
+// Flatten composites the Framebuffer's pixels over the background color bg,
+// leaving every pixel fully opaque.
+func (f *Framebuffer) Flatten(bg color.RGBA) {
+	pixels := f.buf[:f.width*f.height*4]
+	for i := 0; i < len(pixels); i += 4 {
+		alpha := uint32(pixels[i+3])
+		if alpha == 255 {
+			continue
+		}
+		inv := 255 - alpha
+		pixels[i] = uint8((uint32(pixels[i])*alpha + uint32(bg.B)*inv + 127) / 255)
+		pixels[i+1] = uint8((uint32(pixels[i+1])*alpha + uint32(bg.G)*inv + 127) / 255)
+		pixels[i+2] = uint8((uint32(pixels[i+2])*alpha + uint32(bg.R)*inv + 127) / 255)
+		pixels[i+3] = 255
+	}
+}
+
+// hasTransparency reports whether any pixel is translucent enough for the GIF
+// encoder to write it as transparent
+func (f *Framebuffer) hasTransparency() bool {
+	pixels := f.buf[:f.width*f.height*4]
+	for i := 3; i < len(pixels); i += 4 {
+		if pixels[i] < 128 {
+			return true
+		}
+	}
+	return false
+}
+
+const (
+	ssimWindowSize = 8
+	ssimWindowStep = 4
+	ssimC1         = (0.01 * 255) * (0.01 * 255)
+	ssimC2         = (0.03 * 255) * (0.03 * 255)
+)
+
+// SSIM returns the structural similarity of the Framebuffer's luma to that of
+// other, averaged over 8x8 windows. The result is 1.0 for identical pixels and
+// decreases as the images diverge. SSIM returns 0 if either Framebuffer has
+// no pixels or their dimensions differ.
+func (f *Framebuffer) SSIM(other *Framebuffer) float64 {
+	if f.mat == nil || other.mat == nil || f.width != other.width || f.height != other.height {
+		return 0
+	}
+
+	lumaA := f.luma()
+	lumaB := other.luma()
+
+	window := ssimWindowSize
+	if f.width < window {
+		window = f.width
+	}
+	if f.height < window {
+		window = f.height
+	}
+
+	var total float64
+	windows := 0
+	for top := 0; top+window <= f.height; top += ssimWindowStep {
+		for left := 0; left+window <= f.width; left += ssimWindowStep {
+			total += ssimWindow(lumaA, lumaB, f.width, left, top, window)
+			windows++
+		}
+	}
+	return total / float64(windows)
+}
+
+// luma returns the Rec. 601 luma of each pixel of the BGRA Framebuffer
+func (f *Framebuffer) luma() []float64 {
+	luma := make([]float64, f.width*f.height)
+	for i := range luma {
+		px := f.buf[4*i : 4*i+4]
+		luma[i] = 0.114*float64(px[0]) + 0.587*float64(px[1]) + 0.299*float64(px[2])
+	}
+	return luma
+}
+
+// ssimWindow computes the SSIM of the size x size window at left, top in two
+// luma planes of the given stride
+func ssimWindow(a, b []float64, stride, left, top, size int) float64 {
+	n := float64(size * size)
+	var sumA, sumB float64
+	for y := top; y < top+size; y++ {
+		for x := left; x < left+size; x++ {
+			sumA += a[y*stride+x]
+			sumB += b[y*stride+x]
+		}
+	}
+	meanA := sumA / n
+	meanB := sumB / n
+
+	var varA, varB, covar float64
+	for y := top; y < top+size; y++ {
+		for x := left; x < left+size; x++ {
+			da := a[y*stride+x] - meanA
+			db := b[y*stride+x] - meanB
+			varA += da * da
+			varB += db * db
+			covar += da * db
+		}
+	}
+	varA /= n
+	varB /= n
+	covar /= n
+
+	return ((2*meanA*meanB + ssimC1) * (2*covar + ssimC2)) /
+		((meanA*meanA + meanB*meanB + ssimC1) * (varA + varB + ssimC2))
+}
+
 func (f *Framebuffer) resizeMat(width, height int, pixelType PixelType) error {
 	if f.mat != nil {
 		C.opencv_mat_release(f.mat)
@@ -148,7 +272,14 @@ func (f *Framebuffer) resizeMat(width, height int, pixelType PixelType) error {
 	return nil
 }
 
+// Fit performs a cropping resize of the Framebuffer into dst, preserving the
+// aspect ratio of the requested dimensions.
 func (f *Framebuffer) Fit(width, height int, dst *Framebuffer) error {
+	return f.FitWithInterpolation(width, height, InterpolationArea, dst)
+}
+
+// FitWithInterpolation is like Fit but resamples using the given interpolation.
+func (f *Framebuffer) FitWithInterpolation(width, height int, interp InterpolationFlags, dst *Framebuffer) error {
 	if f.mat == nil {
 		return ErrFrameBufNoPixels
 	}
@@ -194,15 +325,184 @@ func (f *Framebuffer) Fit(width, height int, dst *Framebuffer) error {
 	if err != nil {
 		return err
 	}
-	C.opencv_mat_resize(newMat, dst.mat, C.int(width), C.int(height), C.int(InterpolationArea))
+	C.opencv_mat_resize(newMat, dst.mat, C.int(width), C.int(height), C.int(interp))
 	return nil
 }
 
+// FitDisplayAspect resizes a Framebuffer whose pixels are pixelAspect times
+// as wide as they are tall into dst with square pixels. The source is center
+// cropped so the output has the given display aspect ratio (width / height),
+// and the output is height pixels tall. A 720x480 NTSC frame with a pixel
+// aspect of 8/9 fits a 4:3 display aspect as 640x480 without cropping.
+func (f *Framebuffer) FitDisplayAspect(pixelAspect, displayAspect float64, height int, interp InterpolationFlags, dst *Framebuffer) error {
+	if f.mat == nil {
+		return ErrFrameBufNoPixels
+	}
+
+	if !(pixelAspect > 0) || !(displayAspect > 0) {
+		return ErrInvalidAspectRatio
+	}
+
+	// the crop is worked out in display units, where the source is
+	// width * pixelAspect wide, then mapped back to stored pixels
+	displayWidth := float64(f.width) * pixelAspect
+	crop := image.Rect(0, 0, f.width, f.height)
+	if displayWidth/float64(f.height) > displayAspect {
+		cropWidth := int(displayAspect*float64(f.height)/pixelAspect + 0.5)
+		if cropWidth < 1 {
+			cropWidth = 1
+		}
+		crop.Min.X = (f.width - cropWidth) / 2
+		crop.Max.X = crop.Min.X + cropWidth
+	} else {
+		cropHeight := int(displayWidth/displayAspect + 0.5)
+		if cropHeight < 1 {
+			cropHeight = 1
+		}
+		crop.Min.Y = (f.height - cropHeight) / 2
+		crop.Max.Y = crop.Min.Y + cropHeight
+	}
+
+	src := f.view(crop)
+	defer src.Close()
+	return src.ResizeToWithInterpolation(int(float64(height)*displayAspect+0.5), height, interp, dst)
+}
+
+// CropCenterSquare crops the largest centered square out of the Framebuffer
+// and puts it in dst without resampling. The square's sides are the lesser of
+// the Framebuffer's width and height.
+func (f *Framebuffer) CropCenterSquare(dst *Framebuffer) error {
+	if f.mat == nil {
+		return ErrFrameBufNoPixels
+	}
+
+	size := f.width
+	if f.height < size {
+		size = f.height
+	}
+	left := (f.width - size) / 2
+	top := (f.height - size) / 2
+
+	newMat := C.opencv_mat_crop(f.mat, C.int(left), C.int(top), C.int(size), C.int(size))
+	defer C.opencv_mat_release(newMat)
+
+	err := dst.resizeMat(size, size, f.pixelType)
+	if err != nil {
+		return err
+	}
+	C.opencv_mat_copy(newMat, dst.mat)
+	return nil
+}
+
+// TrimOptions controls how Trim detects the border to remove
+type TrimOptions struct {
+	// Tolerance is, per channel, how far a pixel may differ from the top left
+	// pixel and still be counted as part of the border
+	Tolerance color.RGBA
+
+	// IncludeAlpha compares alpha as well as color. When it is not set, a
+	// pixel that matches the border color is border whatever its opacity
+	IncludeAlpha bool
+}
+
+// Trim removes the border of pixels matching the top left pixel within the
+// tolerances in opt and puts what remains in dst without resampling. An image
+// that is all border is copied whole.
+func (f *Framebuffer) Trim(opt TrimOptions, dst *Framebuffer) error {
+	if f.mat == nil {
+		return ErrFrameBufNoPixels
+	}
+
+	r := f.trimBounds(opt)
+	if r.Empty() {
+		r = image.Rect(0, 0, f.width, f.height)
+	}
+
+	newMat := C.opencv_mat_crop(f.mat, C.int(r.Min.X), C.int(r.Min.Y), C.int(r.Dx()), C.int(r.Dy()))
+	defer C.opencv_mat_release(newMat)
+
+	err := dst.resizeMat(r.Dx(), r.Dy(), f.pixelType)
+	if err != nil {
+		return err
+	}
+	C.opencv_mat_copy(newMat, dst.mat)
+	return nil
+}
+
+// trimBounds returns the smallest rectangle holding every pixel that differs
+// from the top left pixel by more than opt allows
+func (f *Framebuffer) trimBounds(opt TrimOptions) image.Rectangle {
+	// tolerances in the Framebuffer's BGRA order
+	tolerance := [4]int{int(opt.Tolerance.B), int(opt.Tolerance.G), int(opt.Tolerance.R), int(opt.Tolerance.A)}
+	channels := 3
+	if opt.IncludeAlpha {
+		channels = 4
+	}
+
+	ref := f.buf[:4]
+	var bounds image.Rectangle
+	for y := 0; y < f.height; y++ {
+		for x := 0; x < f.width; x++ {
+			px := f.buf[4*(y*f.width+x):]
+			for c := 0; c < channels; c++ {
+				diff := int(px[c]) - int(ref[c])
+				if diff < 0 {
+					diff = -diff
+				}
+				if diff > tolerance[c] {
+					bounds = bounds.Union(image.Rect(x, y, x+1, y+1))
+					break
+				}
+			}
+		}
+	}
+	return bounds
+}
+
+// OrientationTransformTo flips and rotates the Framebuffer to undo the given
+// orientation and puts the result in dst.
+func (f *Framebuffer) OrientationTransformTo(orientation ImageOrientation, dst *Framebuffer) error {
+	if f.mat == nil {
+		return ErrFrameBufNoPixels
+	}
+
+	width, height := f.width, f.height
+	if orientation.transposes() {
+		width, height = height, width
+	}
+
+	err := dst.resizeMat(width, height, f.pixelType)
+	if err != nil {
+		return err
+	}
+	C.opencv_mat_orientation_transform(C.int(orientation), f.mat, dst.mat)
+	return nil
+}
+
+// view returns a Framebuffer sharing the pixels of f within r. Closing the
+// view does not affect f.
+func (f *Framebuffer) view(r image.Rectangle) *Framebuffer {
+	return &Framebuffer{
+		buf:       f.buf,
+		mat:       C.opencv_mat_crop(f.mat, C.int(r.Min.X), C.int(r.Min.Y), C.int(r.Dx()), C.int(r.Dy())),
+		width:     r.Dx(),
+		height:    r.Dy(),
+		pixelType: f.pixelType,
+		duration:  f.duration,
+	}
+}
+
 // ResizeTo performs a resizing transform on the Framebuffer and puts the result
 // in the provided destination Framebuffer. This function does not preserve aspect
 // ratio if the given dimensions differ in ratio from the source. Returns an error
 // if the destination is not large enough to hold the given dimensions.
 func (f *Framebuffer) ResizeTo(width, height int, dst *Framebuffer) error {
+	return f.ResizeToWithInterpolation(width, height, InterpolationArea, dst)
+}
+
+// ResizeToWithInterpolation is like ResizeTo but resamples using the given
+// interpolation.
+func (f *Framebuffer) ResizeToWithInterpolation(width, height int, interp InterpolationFlags, dst *Framebuffer) error {
 	if width < 1 {
 		width = 1
 	}
@@ -215,10 +515,128 @@ func (f *Framebuffer) ResizeTo(width, height int, dst *Framebuffer) error {
 	if err != nil {
 		return err
 	}
-	C.opencv_mat_resize(f.mat, dst.mat, C.int(width), C.int(height), C.int(InterpolationArea))
+	C.opencv_mat_resize(f.mat, dst.mat, C.int(width), C.int(height), C.int(interp))
 	return nil
 }
 
+// InterpolationCostEstimate returns a static estimate of the relative cost of
+// resampling with interp. It is not measured: it is the number of source
+// pixels the kernel reads along each axis for every output pixel, 1 for
+// nearest neighbor, 2 for linear, 4 for cubic and 8 for Lanczos.
+// InterpolationArea matches linear when enlarging but reads every covered
+// source pixel when shrinking, so its cost grows with the reduction; the
+// enlarging cost is returned. Unknown flags return 0. Run
+// BenchmarkFramebufferResize for measured timings on a particular machine.
+func InterpolationCostEstimate(interp InterpolationFlags) int {
+	switch interp {
+	case InterpolationNearestNeighbor:
+		return 1
+	case InterpolationLinear, InterpolationArea:
+		return 2
+	case InterpolationCubic:
+		return 4
+	case InterpolationLanczos4:
+		return 8
+	}
+	return 0
+}
+
+// ResizeIntoBuffer is like ResizeToWithInterpolation but writes the result
+// into dst, a caller-owned buffer in the Framebuffer's pixel type whose rows
+// start stride bytes apart, rather than into another Framebuffer. Bytes between
+// the end of each row and the next stride are left untouched. Returns
+// ErrInvalidStride if stride is shorter than a row of width pixels, or
+// ErrBufTooSmall if dst cannot hold height rows.
+func (f *Framebuffer) ResizeIntoBuffer(width, height, stride int, interp InterpolationFlags, dst []byte) error {
+	if f.mat == nil {
+		return ErrFrameBufNoPixels
+	}
+
+	if width < 1 {
+		width = 1
+	}
+
+	if height < 1 {
+		height = 1
+	}
+
+	rowSize := width * int(C.opencv_type_elem_size(C.int(f.pixelType)))
+	if stride < rowSize {
+		return ErrInvalidStride
+	}
+	if len(dst) < (height-1)*stride+rowSize {
+		return ErrBufTooSmall
+	}
+
+	mat := C.opencv_mat_create_from_data_with_stride(C.int(width), C.int(height), C.int(f.pixelType), unsafe.Pointer(&dst[0]), C.size_t(len(dst)), C.size_t(stride))
+	if mat == nil {
+		return ErrBufTooSmall
+	}
+	defer C.opencv_mat_release(mat)
+
+	C.opencv_mat_resize(f.mat, mat, C.int(width), C.int(height), C.int(interp))
+	return nil
+}
+
+// GifDisposal is the method a GIF frame requests for clearing its area before
+// the next frame is drawn
+type GifDisposal int
+
+const (
+	// GifDisposalUnspecified leaves disposal up to the viewer
+	GifDisposalUnspecified GifDisposal = 0
+
+	// GifDisposalNone leaves the frame in place
+	GifDisposalNone GifDisposal = 1
+
+	// GifDisposalBackground restores the frame's area to the background color
+	GifDisposalBackground GifDisposal = 2
+
+	// GifDisposalPrevious restores the frame's area to what it was before the
+	// frame was drawn
+	GifDisposalPrevious GifDisposal = 3
+)
+
+// Encode options understood by the GIF encoder. These are used as keys in the
+// opt map passed to GifEncoder.Encode, e.g. map[int]int{GifOutputDisposal: 2}.
+// They start well above the IMWrite flags so that one map can hold both
+const (
+	// GifOutputDisposal forces every output frame to use the given GifDisposal
+	// instead of the disposal method of the corresponding input frame
+	GifOutputDisposal = iota + 0x10000
+
+	// GifVersion selects the version written, GifVersion87a or GifVersion89a.
+	// GIF87a cannot store animation or transparency, so images needing either
+	// are written as GIF89a regardless
+	GifVersion
+
+	// GifOptimizeFrameBounds, when non-zero, crops each frame drawn over the
+	// previous one to the rectangle that changed and offsets it to match
+	GifOptimizeFrameBounds
+)
+
+const (
+	GifVersion87a = 87
+	GifVersion89a = 89
+)
+
+// GifFrameInfo describes the layout of a single frame of a GIF
+type GifFrameInfo struct {
+	// Left and Top are the frame's offset within the image
+	Left int
+	Top  int
+
+	// Width and Height are the frame's dimensions in pixels
+	Width  int
+	Height int
+
+	// Delay is how long the frame is shown before the next one
+	Delay time.Duration
+
+	// Disposal is how the frame is cleared before the next one is drawn
+	Disposal GifDisposal
+}
+
 type GifDecoder interface {
 	// Header returns basic image metadata from the image.
 	// This is done lazily, reading only the first part of the image and not
@@ -243,6 +661,11 @@ type GifDecoder interface {
 	// SkipFrame skips a frame if the decoder supports multiple frames
 	// and returns io.EOF if the last frame has been reached
 	SkipFrame() error
+
+	// FrameInfos returns the layout of every frame in the image. Only the
+	// block headers are read, so no pixel data is decoded and the decoder's
+	// position is unaffected.
+	FrameInfos() ([]GifFrameInfo, error)
 }
 
 // An Encoder compresses raw pixel data into a well-known image type.
@@ -298,9 +721,22 @@ type gifDecoder struct {
 type gifEncoder struct {
 	encoder    C.giflib_encoder
 	decoder    C.giflib_decoder
+	source     []byte
+	iccProfile []byte
 	buf        []byte
 	frameIndex int
 	hasFlushed bool
+
+	// paletteColor, if set, is added to the output palettes so that pixels
+	// of that color are written exactly
+	paletteColor *color.RGBA
+
+	// stripXMP leaves the input's XMP packet out of the output
+	stripXMP bool
+
+	// wroteGif87 is set once the output is written as GIF87a, which leaves
+	// out every extension block of the input
+	wroteGif87 bool
 }
 
 const defaultMaxFrameDimension = 10000
@@ -309,8 +745,80 @@ var (
 	gifMaxFrameDimension uint64
 
 	ErrGifEncoderNeedsDecoder = errors.New("GIF encoder needs decoder used to create image")
+	ErrInvalidGifDisposal     = errors.New("GIF disposal method must be between 0 and 3")
+
+	ErrGifFrameOutOfBounds       = errors.New("GIF frame extends outside of image bounds")
+	ErrGifPaletteIndexOutOfRange = errors.New("GIF frame references a color outside of its palette")
 )
 
+// BackendThreads returns the number of threads OpenCV uses for parallel
+// regions such as resizing.
+func BackendThreads() int {
+	return int(C.opencv_get_num_threads())
+}
+
+// backendThreadCaps tracks the thread caps of operations running under
+// withBackendThreads. OpenCV's thread count is process-wide, so while any
+// capped operation runs it is set to the smallest active cap, and the
+// original count is restored once the last one returns.
+var backendThreadCaps struct {
+	sync.Mutex
+	original C.int
+	active   map[int]int // cap -> number of operations holding it
+}
+
+// applyBackendThreadCaps sets OpenCV's thread count from the active caps. The
+// caller must hold backendThreadCaps.
+func applyBackendThreadCaps() {
+	if len(backendThreadCaps.active) == 0 {
+		C.opencv_set_num_threads(backendThreadCaps.original)
+		return
+	}
+	min := 0
+	for n := range backendThreadCaps.active {
+		if min == 0 || n < min {
+			min = n
+		}
+	}
+	C.opencv_set_num_threads(C.int(min))
+}
+
+// acquireBackendThreads adds a cap of n threads
+func acquireBackendThreads(n int) {
+	backendThreadCaps.Lock()
+	defer backendThreadCaps.Unlock()
+	if len(backendThreadCaps.active) == 0 {
+		backendThreadCaps.original = C.opencv_get_num_threads()
+		backendThreadCaps.active = map[int]int{}
+	}
+	backendThreadCaps.active[n]++
+	applyBackendThreadCaps()
+}
+
+// releaseBackendThreads removes a cap added by acquireBackendThreads
+func releaseBackendThreads(n int) {
+	backendThreadCaps.Lock()
+	defer backendThreadCaps.Unlock()
+	backendThreadCaps.active[n]--
+	if backendThreadCaps.active[n] == 0 {
+		delete(backendThreadCaps.active, n)
+	}
+	applyBackendThreadCaps()
+}
+
+// withBackendThreads runs fn with OpenCV limited to at most n threads. Caps
+// from concurrent calls combine, with the smallest one in effect, and the
+// limit OpenCV had before the first of them is restored when the last
+// returns. n <= 0 leaves the limit unchanged.
+func withBackendThreads(n int, fn func() ([]byte, error)) ([]byte, error) {
+	if n <= 0 {
+		return fn()
+	}
+	acquireBackendThreads(n)
+	defer releaseBackendThreads(n)
+	return fn()
+}
+
 // SetGIFMaxFrameDimension sets the largest GIF width/height that can be
 // decoded
 func SetGIFMaxFrameDimension(dim uint64) {
@@ -358,6 +866,17 @@ func (d *gifDecoder) FrameHeader() (*ImageHeader, error) {
 	}, nil
 }
 
+// BackgroundColor returns the color the GIF's background color index refers
+// to. The second return value is false if the GIF has no global palette for
+// the index to refer to.
+func (d *gifDecoder) BackgroundColor() (color.RGBA, bool) {
+	packed := int(C.giflib_decoder_get_background_color(d.decoder))
+	if packed < 0 {
+		return color.RGBA{}, false
+	}
+	return color.RGBA{R: uint8(packed >> 16), G: uint8(packed >> 8), B: uint8(packed), A: 255}, true
+}
+
 func (d *gifDecoder) Close() {
 	C.giflib_decoder_release(d.decoder)
 	C.opencv_mat_release(d.mat)
@@ -409,6 +928,19 @@ func (d *gifDecoder) DecodeTo(f *Framebuffer) error {
 	return nil
 }
 
+// warning returns an error describing the first recoverable problem the
+// decoder has encountered so far, or nil if the image decoded cleanly
+func (d *gifDecoder) warning() error {
+	warnings := int(C.giflib_decoder_get_warnings(d.decoder))
+	if warnings&C.giflib_decoder_warning_frame_out_of_bounds != 0 {
+		return ErrGifFrameOutOfBounds
+	}
+	if warnings&C.giflib_decoder_warning_palette_index_out_of_range != 0 {
+		return ErrGifPaletteIndexOutOfRange
+	}
+	return nil
+}
+
 func (d *gifDecoder) SkipFrame() error {
 	nextFrameResult := int(C.giflib_decoder_skip_frame(d.decoder))
 
@@ -422,6 +954,124 @@ func (d *gifDecoder) SkipFrame() error {
 	return nil
 }
 
+func (d *gifDecoder) FrameInfos() ([]GifFrameInfo, error) {
+	return parseGifFrameInfos(d.buf)
+}
+
+const (
+	gifExtensionIntroducer = 0x21
+	gifImageSeparator      = 0x2c
+	gifTrailer             = 0x3b
+	gifGraphicControlLabel = 0xf9
+	gifCommentLabel        = 0xfe
+	gifApplicationLabel    = 0xff
+	gifColorTableFlag      = 0x80
+	gifColorTableSizeMask  = 0x07
+	gifScreenDescriptorLen = 13
+	gifImageDescriptorLen  = 10
+	gifGraphicControlLen   = 4
+	gifDisposalShift       = 2
+	gifDisposalMask        = 0x07
+	gifDelayUnit           = 10 * time.Millisecond
+)
+
+// gifColorTableLen returns the size in bytes of the color table described by
+// a packed fields byte
+func gifColorTableLen(packed byte) int {
+	if packed&gifColorTableFlag == 0 {
+		return 0
+	}
+	return 3 * (1 << (uint(packed&gifColorTableSizeMask) + 1))
+}
+
+// skipGifSubBlocks returns the offset just past the sub-block chain starting
+// at offset i
+func skipGifSubBlocks(buf []byte, i int) (int, error) {
+	for {
+		if i >= len(buf) {
+			return 0, ErrInvalidImage
+		}
+		n := int(buf[i])
+		i++
+		if n == 0 {
+			return i, nil
+		}
+		i += n
+	}
+}
+
+// walkGifBlocks calls visit with each extension and image block of the GIF in
+// buf, from its introducer up to and including its block terminator. Image
+// data is skipped over without being decoded.
+func walkGifBlocks(buf []byte, visit func(block []byte)) error {
+	if !isGIF(buf) || len(buf) < gifScreenDescriptorLen {
+		return ErrInvalidImage
+	}
+
+	i := gifScreenDescriptorLen + gifColorTableLen(buf[10])
+	for {
+		if i >= len(buf) {
+			// tolerate a missing trailer, which is common in the wild
+			return nil
+		}
+
+		start := i
+		var err error
+		switch buf[i] {
+		case gifExtensionIntroducer:
+			if i+2 > len(buf) {
+				return ErrInvalidImage
+			}
+			i, err = skipGifSubBlocks(buf, i+2)
+		case gifImageSeparator:
+			if i+gifImageDescriptorLen > len(buf) {
+				return ErrInvalidImage
+			}
+			// skip the local color table and the LZW minimum code size
+			i += gifImageDescriptorLen + gifColorTableLen(buf[i+gifImageDescriptorLen-1]) + 1
+			i, err = skipGifSubBlocks(buf, i)
+		case gifTrailer:
+			return nil
+		default:
+			return ErrInvalidImage
+		}
+
+		if err != nil {
+			return err
+		}
+		visit(buf[start:i])
+	}
+}
+
+// parseGifFrameInfos collects the frame descriptors and graphic control
+// extensions of the GIF in buf
+func parseGifFrameInfos(buf []byte) ([]GifFrameInfo, error) {
+	var infos []GifFrameInfo
+	var pending GifFrameInfo
+	err := walkGifBlocks(buf, func(block []byte) {
+		switch block[0] {
+		case gifExtensionIntroducer:
+			if block[1] == gifGraphicControlLabel && len(block) >= 3+gifGraphicControlLen && block[2] == gifGraphicControlLen {
+				gce := block[3:]
+				pending.Disposal = GifDisposal((gce[0] >> gifDisposalShift) & gifDisposalMask)
+				pending.Delay = time.Duration(int(gce[1])|int(gce[2])<<8) * gifDelayUnit
+			}
+		case gifImageSeparator:
+			desc := block[1:gifImageDescriptorLen]
+			pending.Left = int(desc[0]) | int(desc[1])<<8
+			pending.Top = int(desc[2]) | int(desc[3])<<8
+			pending.Width = int(desc[4]) | int(desc[5])<<8
+			pending.Height = int(desc[6]) | int(desc[7])<<8
+			infos = append(infos, pending)
+			pending = GifFrameInfo{}
+		}
+	})
+	if err != nil {
+		return nil, err
+	}
+	return infos, nil
+}
+
 func newGifEncoder(decodedBy GifDecoder, buf []byte) (*gifEncoder, error) {
 	// we must have a decoder since we can't build our own palettes
 	// so if we don't get a gif decoder, bail out
@@ -443,6 +1093,7 @@ func newGifEncoder(decodedBy GifDecoder, buf []byte) (*gifEncoder, error) {
 	return &gifEncoder{
 		encoder:    enc,
 		decoder:    gifDecoder.decoder,
+		source:     gifDecoder.buf,
 		buf:        buf,
 		frameIndex: 0,
 	}, nil
@@ -465,10 +1116,37 @@ func (e *gifEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
 		return e.buf[:len], nil
 	}
 
+	if disposal, ok := opt[GifOutputDisposal]; ok {
+		if disposal < int(GifDisposalUnspecified) || disposal > int(GifDisposalPrevious) {
+			return nil, ErrInvalidGifDisposal
+		}
+		C.giflib_encoder_set_disposal(e.encoder, C.int(disposal))
+	}
+
+	if optimize, ok := opt[GifOptimizeFrameBounds]; ok {
+		C.giflib_encoder_set_optimize_bounds(e.encoder, C.bool(optimize != 0))
+	}
+
 	if e.frameIndex == 0 {
 		// first run setup
+		if opt[GifVersion] == GifVersion87a && e.canWriteGif87(f) {
+			C.giflib_encoder_set_gif87(e.encoder, true)
+			e.wroteGif87 = true
+		}
+		if e.stripXMP {
+			C.giflib_encoder_set_strip_xmp(e.encoder, true)
+		}
+		if c := e.paletteColor; c != nil {
+			C.giflib_encoder_add_palette_color(e.encoder, C.int(c.R), C.int(c.G), C.int(c.B))
+		}
 		// TODO figure out actual gif width/height?
 		C.giflib_encoder_init(e.encoder, e.decoder, C.int(f.Width()), C.int(f.Height()))
+
+		if len(e.iccProfile) > 0 {
+			if !C.giflib_encoder_write_icc_profile(e.encoder, unsafe.Pointer(&e.iccProfile[0]), C.size_t(len(e.iccProfile))) {
+				return nil, ErrBufTooSmall
+			}
+		}
 	}
 
 	if !C.giflib_encoder_encode_frame(e.encoder, e.decoder, f.mat) {
@@ -480,6 +1158,31 @@ func (e *gifEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
 	return nil, nil
 }
 
+// canWriteGif87 reports whether the image whose first frame is f can be
+// written without GIF89a extensions, i.e. it is static and opaque
+func (e *gifEncoder) canWriteGif87(f *Framebuffer) bool {
+	if len(e.iccProfile) > 0 {
+		// the profile is stored in an extension
+		return false
+	}
+
+	infos, err := parseGifFrameInfos(e.source)
+	if err != nil || len(infos) > 1 {
+		return false
+	}
+	return !f.hasTransparency()
+}
+
+// strippedMetadata reports whether the output leaves out metadata carried by
+// the input, either its XMP packet or, for GIF87a, its comment and
+// application extensions
+func (e *gifEncoder) strippedMetadata() bool {
+	if e.stripXMP && gifXMP(e.source) != nil {
+		return true
+	}
+	return e.wroteGif87 && gifHasMetadata(e.source)
+}
+
 func (e *gifEncoder) Close() {
 	C.giflib_encoder_release(e.encoder)
 }
@@ -18,12 +18,25 @@ typedef enum {
     giflib_decoder_error,
 } giflib_decoder_frame_state;
 
+typedef enum {
+    giflib_decoder_warning_frame_out_of_bounds = 1 << 0,
+    giflib_decoder_warning_palette_index_out_of_range = 1 << 1,
+} giflib_decoder_warning;
+
 typedef void* opencv_mat;
 typedef void* opencv_decoder;
 typedef void* opencv_encoder;
 
 opencv_mat opencv_mat_create_from_data(int width, int height, int type, void* data, size_t data_len);
+opencv_mat opencv_mat_create_from_data_with_stride(int width,
+                                                int height,
+                                                int type,
+                                                void* data,
+                                                size_t data_len,
+                                                size_t stride);
 opencv_mat opencv_mat_crop(const opencv_mat src, int x, int y, int width, int height);
+void opencv_mat_copy(const opencv_mat src, opencv_mat dst);
+void opencv_mat_orientation_transform(int orientation, const opencv_mat src, opencv_mat dst);
 void opencv_mat_resize(const opencv_mat src,
                        opencv_mat dst,
                        int width,
@@ -31,6 +44,9 @@ void opencv_mat_resize(const opencv_mat src,
                        int interpolation);
 void opencv_mat_release(opencv_mat mat);
 int opencv_type_depth(int type);
+int opencv_type_elem_size(int type);
+int opencv_get_num_threads();
+void opencv_set_num_threads(int n);
 int opencv_type_convert_depth(int type, int depth);
 
 giflib_decoder giflib_decoder_create(const opencv_mat buf);
@@ -40,13 +56,21 @@ int giflib_decoder_get_num_frames(const giflib_decoder d);
 int giflib_decoder_get_frame_width(const giflib_decoder d);
 int giflib_decoder_get_frame_height(const giflib_decoder d);
 int giflib_decoder_get_prev_frame_delay(const giflib_decoder d);
+int giflib_decoder_get_warnings(const giflib_decoder d);
+int giflib_decoder_get_background_color(const giflib_decoder d);
 void giflib_decoder_release(giflib_decoder d);
 giflib_decoder_frame_state giflib_decoder_decode_frame_header(giflib_decoder d);
 bool giflib_decoder_decode_frame(giflib_decoder d, opencv_mat mat);
 giflib_decoder_frame_state giflib_decoder_skip_frame(giflib_decoder d);
 
 giflib_encoder giflib_encoder_create(void* buf, size_t buf_len);
+void giflib_encoder_set_disposal(giflib_encoder e, int disposal);
+void giflib_encoder_set_gif87(giflib_encoder e, bool gif87);
+void giflib_encoder_set_optimize_bounds(giflib_encoder e, bool optimize_bounds);
+void giflib_encoder_add_palette_color(giflib_encoder e, int r, int g, int b);
+void giflib_encoder_set_strip_xmp(giflib_encoder e, bool strip_xmp);
 bool giflib_encoder_init(giflib_encoder e, const giflib_decoder d, int width, int height);
+bool giflib_encoder_write_icc_profile(giflib_encoder e, const void* profile, size_t profile_len);
 bool giflib_encoder_encode_frame(giflib_encoder e, const giflib_decoder d, const opencv_mat frame);
 bool giflib_encoder_flush(giflib_encoder e, const giflib_decoder d);
 void giflib_encoder_release(giflib_encoder e);
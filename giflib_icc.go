@@ -0,0 +1,194 @@
+package gocv
+
+import (
+	"errors"
+	"math"
+	"unicode/utf16"
+)
+
+// Names of the color profiles that can be embedded with GifOptions.EmbedProfile
+const (
+	ColorProfileSRGB      = "sRGB"
+	ColorProfileDisplayP3 = "Display P3"
+)
+
+var ErrUnknownColorProfile = errors.New("unknown color profile name")
+
+// iccPrimaries are the D50-adapted XYZ colorants of an RGB color space
+type iccPrimaries struct {
+	red, green, blue [3]float64
+}
+
+var (
+	// D50, the ICC profile connection space illuminant
+	iccD50 = [3]float64{0.9642, 1.0, 0.8249}
+
+	// Bradford adaptation from D65 to D50, rows first
+	iccD65ToD50 = [9]float64{
+		1.0478112, 0.0228866, -0.0501270,
+		0.0295424, 0.9904844, -0.0170491,
+		-0.0092345, 0.0150436, 0.7521316,
+	}
+
+	// the sRGB transfer function as a parametric curve of type 3:
+	// Y = (aX+b)^g for X >= d, Y = cX otherwise
+	iccSRGBCurve = [5]float64{2.4, 1 / 1.055, 0.055 / 1.055, 1 / 12.92, 0.04045}
+
+	namedColorProfiles = map[string][]byte{
+		ColorProfileSRGB: buildICCProfile(ColorProfileSRGB, iccPrimaries{
+			red:   [3]float64{0.4361, 0.2225, 0.0139},
+			green: [3]float64{0.3851, 0.7169, 0.0971},
+			blue:  [3]float64{0.1431, 0.0606, 0.7141},
+		}),
+		ColorProfileDisplayP3: buildICCProfile(ColorProfileDisplayP3, iccPrimaries{
+			red:   [3]float64{0.5151, 0.2412, -0.0011},
+			green: [3]float64{0.2920, 0.6922, 0.0419},
+			blue:  [3]float64{0.1571, 0.0666, 0.7841},
+		}),
+	}
+)
+
+// namedColorProfile returns the ICC profile with the given name
+func namedColorProfile(name string) ([]byte, error) {
+	profile, ok := namedColorProfiles[name]
+	if !ok {
+		return nil, ErrUnknownColorProfile
+	}
+	return profile, nil
+}
+
+// iccWriter accumulates big-endian ICC profile data
+type iccWriter struct {
+	buf []byte
+}
+
+func (w *iccWriter) uint16(v uint16) {
+	w.buf = append(w.buf, byte(v>>8), byte(v))
+}
+
+func (w *iccWriter) uint32(v uint32) {
+	w.buf = append(w.buf, byte(v>>24), byte(v>>16), byte(v>>8), byte(v))
+}
+
+func (w *iccWriter) sig(s string) {
+	w.buf = append(w.buf, s[:4]...)
+}
+
+func (w *iccWriter) s15Fixed16(v float64) {
+	w.uint32(uint32(int32(math.Round(v * 65536))))
+}
+
+func (w *iccWriter) align() {
+	for len(w.buf)%4 != 0 {
+		w.buf = append(w.buf, 0)
+	}
+}
+
+func iccXYZTag(xyz [3]float64) []byte {
+	w := &iccWriter{}
+	w.sig("XYZ ")
+	w.uint32(0)
+	for _, v := range xyz {
+		w.s15Fixed16(v)
+	}
+	return w.buf
+}
+
+func iccParametricCurveTag(params [5]float64) []byte {
+	w := &iccWriter{}
+	w.sig("para")
+	w.uint32(0)
+	w.uint16(3)
+	w.uint16(0)
+	for _, v := range params {
+		w.s15Fixed16(v)
+	}
+	return w.buf
+}
+
+func iccMatrixTag(m [9]float64) []byte {
+	w := &iccWriter{}
+	w.sig("sf32")
+	w.uint32(0)
+	for _, v := range m {
+		w.s15Fixed16(v)
+	}
+	return w.buf
+}
+
+func iccTextTag(text string) []byte {
+	const headerLen = 28
+	encoded := utf16.Encode([]rune(text))
+
+	w := &iccWriter{}
+	w.sig("mluc")
+	w.uint32(0)
+	w.uint32(1)  // record count
+	w.uint32(12) // record size
+	w.sig("enUS")
+	w.uint32(uint32(2 * len(encoded)))
+	w.uint32(headerLen)
+	for _, c := range encoded {
+		w.uint16(c)
+	}
+	return w.buf
+}
+
+// buildICCProfile returns an ICC v4 display profile for an RGB color space
+// with the given primaries, a D65 white point and the sRGB transfer function
+func buildICCProfile(description string, primaries iccPrimaries) []byte {
+	const headerLen = 128
+	curve := iccParametricCurveTag(iccSRGBCurve)
+	tags := []struct {
+		sig  string
+		data []byte
+	}{
+		{"desc", iccTextTag(description)},
+		{"cprt", iccTextTag("No copyright, use freely")},
+		{"wtpt", iccXYZTag(iccD50)},
+		{"chad", iccMatrixTag(iccD65ToD50)},
+		{"rXYZ", iccXYZTag(primaries.red)},
+		{"gXYZ", iccXYZTag(primaries.green)},
+		{"bXYZ", iccXYZTag(primaries.blue)},
+		{"rTRC", curve},
+		{"gTRC", curve},
+		{"bTRC", curve},
+	}
+
+	// lay out the tag data after the header and tag table
+	data := &iccWriter{}
+	offsets := make([]int, len(tags))
+	tableLen := 4 + 12*len(tags)
+	for i, tag := range tags {
+		offsets[i] = headerLen + tableLen + len(data.buf)
+		data.buf = append(data.buf, tag.data...)
+		data.align()
+	}
+	size := headerLen + tableLen + len(data.buf)
+
+	w := &iccWriter{}
+	w.uint32(uint32(size))
+	w.uint32(0)          // preferred CMM
+	w.uint32(0x04300000) // version 4.3
+	w.sig("mntr")
+	w.sig("RGB ")
+	w.sig("XYZ ")
+	for _, v := range []uint16{2022, 1, 1, 0, 0, 0} {
+		w.uint16(v) // creation date
+	}
+	w.sig("acsp")
+	w.buf = append(w.buf, make([]byte, 28)...) // platform through rendering intent
+	for _, v := range iccD50 {
+		w.s15Fixed16(v)
+	}
+	w.buf = append(w.buf, make([]byte, headerLen-len(w.buf))...)
+
+	w.uint32(uint32(len(tags)))
+	for i, tag := range tags {
+		w.sig(tag.sig)
+		w.uint32(uint32(offsets[i]))
+		w.uint32(uint32(len(tag.data)))
+	}
+	w.buf = append(w.buf, data.buf...)
+	return w.buf
+}
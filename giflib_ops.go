@@ -1,10 +1,28 @@
 package gocv
 
 import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"image"
+	"image/color"
+	"image/gif"
 	"io"
+	"math"
+	"sync/atomic"
 	"time"
 )
 
+var (
+	ErrUnsupportedFileType = errors.New("unsupported output file type")
+	ErrInvalidScale        = errors.New("scale factors must be positive")
+	ErrInvalidDimensions   = errors.New("width and height must be positive")
+	ErrDimensionsTooLarge  = errors.New("width or height exceeds the maximum frame dimension")
+)
+
+// gifMaxScreenDimension is the largest width or height a GIF can describe
+const gifMaxScreenDimension = 65535
+
 type GifOpsSizeMethod int
 
 const (
@@ -13,6 +31,38 @@ const (
 	GifOpsResize
 )
 
+func (m GifOpsSizeMethod) String() string {
+	switch m {
+	case GifOpsNoResize:
+		return "no-resize"
+	case GifOpsFit:
+		return "fit"
+	case GifOpsResize:
+		return "resize"
+	}
+	return ""
+}
+
+type GifOpsResizeQuality int
+
+const (
+	// GifOpsResizeQualityDefault resamples using pixel area relation
+	GifOpsResizeQualityDefault GifOpsResizeQuality = iota
+
+	// GifOpsResizeQualityAdaptive picks the resampling kernel from the output
+	// dimensions, using nearest neighbor for outputs smaller than
+	// GifOptions.AdaptiveThreshold on both axes and Lanczos otherwise
+	GifOpsResizeQualityAdaptive
+)
+
+// retryScale is how much each dimension is reduced by when retrying a failed
+// encode with RetryReducedDimensions
+const retryScale = 0.9
+
+// defaultAdaptiveThreshold is the output dimension below which
+// GifOpsResizeQualityAdaptive switches to nearest neighbor
+const defaultAdaptiveThreshold = 32
+
 // GifOptions controls how GifOps resizes and encodes the
 // pixel data decoded from a GifDecoder
 type GifOptions struct {
@@ -31,24 +81,175 @@ type GifOptions struct {
 	// resize, while GifOpsResize will stretch the image.
 	ResizeMethod GifOpsSizeMethod
 
+	// MaxAspectDistortion caps how far GifOpsResize may stretch the image, as
+	// the ratio between the output and input aspect ratios. Beyond the cap
+	// GifOpsFit is used instead. Zero allows any amount of stretching
+	MaxAspectDistortion float64
+
+	// ScaleX and ScaleY, when either is set, stretch the input by these
+	// factors along each axis in place of Width, Height and ResizeMethod,
+	// e.g. 2 and 1 to double the width only. An unset factor leaves that axis
+	// unscaled
+	ScaleX float64
+	ScaleY float64
+
+	// ResizeQuality controls which resampling kernel is used to resize frames
+	ResizeQuality GifOpsResizeQuality
+
+	// AdaptiveThreshold is the output dimension, in pixels, at which
+	// GifOpsResizeQualityAdaptive crosses over from nearest neighbor to
+	// Lanczos. Defaults to 32 if zero
+	AdaptiveThreshold int
+
+	// TreatWarningsAsErrors makes Transform fail on images the decoder could
+	// only partially recover, such as frames drawn outside the image bounds
+	TreatWarningsAsErrors bool
+
+	// FlattenTransparency composites frames over a solid background so that
+	// the output contains no transparency. The background color is added to
+	// the output palette if it is missing and there is room; a full
+	// 256-color palette gets its nearest entry instead, as do colors blended
+	// from partially transparent pixels
+	FlattenTransparency bool
+
+	// BackgroundColor is the color transparent pixels are flattened onto. If
+	// it is left fully transparent, the GIF's own background color is used,
+	// or white if the GIF does not define one
+	BackgroundColor color.RGBA
+
+	// BackendThreads caps the number of threads OpenCV may use while
+	// transforming. OpenCV's thread pool is process-wide, so the cap applies
+	// to every concurrent operation; when several capped transforms overlap
+	// the smallest cap holds, and OpenCV's own setting returns once the last
+	// of them finishes. Zero leaves OpenCV's setting unchanged
+	BackendThreads int
+
 	// NormalizeOrientation will flip and rotate the image as necessary
 	// in order to undo EXIF-based orientation
 	// NormalizeOrientation bool
 
+	// ApplyXMPEdits applies the crop and orientation that editors record
+	// non-destructively in an embedded XMP packet. The crop is applied in
+	// the stored orientation before the image is rotated and resized. Once
+	// applied, the XMP packet is left out of the output
+	ApplyXMPEdits bool
+
 	// EncodeOptions controls the encode quality options
 	EncodeOptions map[int]int
 
 	// MaxEncodeFrames controls the maximum number of frames that will be resized
 	MaxEncodeFrames int
 
-	// MaxEncodeDuration controls the maximum duration of animated image that will be resized
+	// MaxEncodeDuration controls the maximum duration of animated image that will be resized.
+	// Frames with no delay add nothing to the running duration, so an animation
+	// made only of them is bounded by MaxEncodeFrames unless ZeroDurationFrameDelay is set
 	MaxEncodeDuration time.Duration
+
+	// ZeroDurationFrameDelay is how long a frame with no delay counts for when
+	// checking MaxEncodeDuration. The delays written to the output are unchanged
+	ZeroDurationFrameDelay time.Duration
+
+	// PassThroughOptimized returns the original image data without re-encoding
+	// when the transform would not change it, e.g. the input is already at the
+	// requested dimensions and no frame limits apply
+	PassThroughOptimized bool
+
+	// DisableUpscaling prevents the output from being larger than the input.
+	// Requested dimensions exceeding the input are scaled down, preserving
+	// their aspect ratio, until they fit within the input
+	DisableUpscaling bool
+
+	// MinUpscaleBelow allows inputs whose width and height are both smaller
+	// than this many pixels to be upscaled even if DisableUpscaling is set
+	MinUpscaleBelow int
+
+	// RetryReducedDimensions retries a failed encode once at slightly reduced
+	// dimensions. Some encoders fail on pathological dimensions that a
+	// small change avoids. A retry is reported by GifManifest.RetriedReduced
+	// and OnRetryReduced
+	RetryReducedDimensions bool
+
+	// OnRetryReduced, if set, is called before RetryReducedDimensions retries
+	// an encode that failed at width x height, with the reduced dimensions it
+	// retries at. It is called whether or not ReturnManifest is set
+	OnRetryReduced func(width, height, retryWidth, retryHeight int)
+
+	// EmbedProfile names a color profile to embed in the output, such as
+	// ColorProfileSRGB or ColorProfileDisplayP3. The profile only tags the
+	// pixels; they are not converted into its color space
+	EmbedProfile string
+
+	// NeverEnlargeBytes returns the original image data if the encoded result
+	// would be larger than the input
+	NeverEnlargeBytes bool
+
+	// ReturnManifest records a GifManifest of what Transform did, which can be
+	// read back as JSON with GifOps.Manifest
+	ReturnManifest bool
+}
+
+// GifManifest describes the operations Transform applied to produce its output
+type GifManifest struct {
+	// FileType is the type the output was encoded as
+	FileType string `json:"file_type"`
+
+	// Width and Height are the dimensions of the output frames
+	Width  int `json:"width"`
+	Height int `json:"height"`
+
+	// Frames is the number of frames in the output
+	Frames int `json:"frames"`
+
+	// ResizeMethod is the method frames were resized with, after any
+	// MaxAspectDistortion fallback
+	ResizeMethod string `json:"resize_method"`
+
+	// Interpolation is the kernel frames were resampled with, empty if they
+	// were not resampled
+	Interpolation string `json:"interpolation,omitempty"`
+
+	// EncodeOptions are the options the output was encoded with
+	EncodeOptions map[int]int `json:"encode_options,omitempty"`
+
+	// ColorProfile is the name of the ICC profile embedded in the output
+	ColorProfile string `json:"color_profile,omitempty"`
+
+	// PassedThrough is set when the original image data was returned
+	PassedThrough bool `json:"passed_through"`
+
+	// RetriedReduced is set when the output was encoded at reduced
+	// dimensions by RetryReducedDimensions
+	RetriedReduced bool `json:"retried_reduced"`
+
+	// MetadataStripped is set when metadata carried by the original image,
+	// such as its XMP packet, was left out of the output
+	MetadataStripped bool `json:"metadata_stripped"`
 }
 
 // GifOps is a reusable object that can resize and encode images.
 type GifOps struct {
 	frames     []*Framebuffer
 	frameIndex int
+	maxSize    int
+
+	// spare holds reoriented frames so that the decoder's canvas in frames
+	// survives until the next frame is drawn. It is allocated on first use
+	spare *Framebuffer
+
+	// newEncoder creates the encoder for each Transform
+	newEncoder func(ext string, decodedBy GifDecoder, dst []byte) (GifEncoder, error)
+
+	// manifest is filled in by Transform when ReturnManifest is set
+	manifest *GifManifest
+}
+
+// encodeError marks an error as having been returned by the encoder
+type encodeError struct {
+	err error
+}
+
+func (e encodeError) Error() string {
+	return e.err.Error()
 }
 
 // NewGifOps creates a new GifOps object that will operate
@@ -60,6 +261,8 @@ func NewGifOps(maxSize int) *GifOps {
 	return &GifOps{
 		frames:     frames,
 		frameIndex: 0,
+		maxSize:    maxSize,
+		newEncoder: NewGifEncoder,
 	}
 }
 
@@ -81,23 +284,51 @@ func (o *GifOps) swap() {
 func (o *GifOps) Clear() {
 	o.frames[0].Clear()
 	o.frames[1].Clear()
+	if o.spare != nil {
+		o.spare.Clear()
+	}
 }
 
 // Close releases resources associated with GifOps
 func (o *GifOps) Close() {
 	o.frames[0].Close()
 	o.frames[1].Close()
+	if o.spare != nil {
+		o.spare.Close()
+	}
 }
 
-func (o *GifOps) decode(d GifDecoder) error {
+func (o *GifOps) decode(d GifDecoder, opt *GifOptions) error {
 	active := o.active()
-	return d.DecodeTo(active)
+	err := d.DecodeTo(active)
+	if err != nil {
+		return err
+	}
+
+	if opt.TreatWarningsAsErrors {
+		if gifDecoder, ok := d.(*gifDecoder); ok {
+			return gifDecoder.warning()
+		}
+	}
+	return nil
 }
 
-func (o *GifOps) fit(d GifDecoder, width, height int) (bool, error) {
+// source returns the active frame, limited to crop if it is not empty
+func (o *GifOps) source(crop image.Rectangle) *Framebuffer {
 	active := o.active()
+	if crop.Empty() {
+		return active
+	}
+	return active.view(crop)
+}
+
+func (o *GifOps) fit(d GifDecoder, crop image.Rectangle, width, height int, interp InterpolationFlags) (bool, error) {
+	active := o.source(crop)
+	if active != o.active() {
+		defer active.Close()
+	}
 	secondary := o.secondary()
-	err := active.Fit(width, height, secondary)
+	err := active.FitWithInterpolation(width, height, interp, secondary)
 	if err != nil {
 		return false, err
 	}
@@ -105,10 +336,13 @@ func (o *GifOps) fit(d GifDecoder, width, height int) (bool, error) {
 	return true, nil
 }
 
-func (o *GifOps) resize(d GifDecoder, width, height int) (bool, error) {
-	active := o.active()
+func (o *GifOps) resize(d GifDecoder, crop image.Rectangle, width, height int, interp InterpolationFlags) (bool, error) {
+	active := o.source(crop)
+	if active != o.active() {
+		defer active.Close()
+	}
 	secondary := o.secondary()
-	err := active.ResizeTo(width, height, secondary)
+	err := active.ResizeToWithInterpolation(width, height, interp, secondary)
 	if err != nil {
 		return false, err
 	}
@@ -116,20 +350,234 @@ func (o *GifOps) resize(d GifDecoder, width, height int) (bool, error) {
 	return true, nil
 }
 
-// func (o *GifOps) normalizeOrientation(orientation ImageOrientation) {
-// 	active := o.active()
-// 	active.OrientationTransform(orientation)
-// }
-
-func (o *GifOps) encode(e GifEncoder, opt map[int]int) ([]byte, error) {
+// normalizeOrientation returns the active frame with orientation undone. A
+// reoriented frame is written to the spare Framebuffer rather than the
+// secondary one, which may hold the decoder's canvas
+func (o *GifOps) normalizeOrientation(orientation ImageOrientation) (*Framebuffer, error) {
 	active := o.active()
-	return e.Encode(active, opt)
+	if orientation <= OrientationTopLeft {
+		return active, nil
+	}
+
+	if o.spare == nil {
+		o.spare = NewFramebuffer(o.maxSize, o.maxSize)
+	}
+	err := active.OrientationTransformTo(orientation, o.spare)
+	if err != nil {
+		return nil, err
+	}
+	return o.spare, nil
+}
+
+func (o *GifOps) encode(e GifEncoder, f *Framebuffer, opt map[int]int) ([]byte, error) {
+	return e.Encode(f, opt)
 }
 
 func (o *GifOps) encodeEmpty(e GifEncoder, opt map[int]int) ([]byte, error) {
 	return e.Encode(nil, opt)
 }
 
+// sourceSize returns the dimensions of the image d decodes, with header h, as
+// it will be displayed once the XMP edits opt asks for are applied
+func sourceSize(d GifDecoder, h *ImageHeader, opt *GifOptions) (int, int) {
+	width, height := h.Width(), h.Height()
+	crop, orientation := appliedXMPEdits(d, h, opt)
+	if !crop.Empty() {
+		width, height = crop.Dx(), crop.Dy()
+	}
+	if orientation.transposes() {
+		width, height = height, width
+	}
+	return width, height
+}
+
+// outputSize returns the dimensions frames of a srcWidth x srcHeight image
+// will be resized to
+func outputSize(srcWidth, srcHeight int, opt *GifOptions) (int, int) {
+	width, height := opt.Width, opt.Height
+	if !opt.DisableUpscaling || width < 1 || height < 1 {
+		return width, height
+	}
+
+	if opt.MinUpscaleBelow > 0 && srcWidth < opt.MinUpscaleBelow && srcHeight < opt.MinUpscaleBelow {
+		return width, height
+	}
+
+	scale := math.Min(float64(srcWidth)/float64(width), float64(srcHeight)/float64(height))
+	if scale >= 1 {
+		return width, height
+	}
+
+	// a very narrow or short input can scale an axis below a whole pixel
+	width, height = int(float64(width)*scale+0.5), int(float64(height)*scale+0.5)
+	if width < 1 {
+		width = 1
+	}
+	if height < 1 {
+		height = 1
+	}
+	return width, height
+}
+
+// resizeInterpolation returns the interpolation used to resize frames to
+// width x height according to opt
+func resizeInterpolation(opt *GifOptions, width, height int) InterpolationFlags {
+	if opt.ResizeQuality != GifOpsResizeQualityAdaptive {
+		return InterpolationArea
+	}
+
+	threshold := opt.AdaptiveThreshold
+	if threshold <= 0 {
+		threshold = defaultAdaptiveThreshold
+	}
+
+	if width < threshold && height < threshold {
+		return InterpolationNearestNeighbor
+	}
+	return InterpolationLanczos4
+}
+
+// flattenColor returns the color transparent pixels of d are flattened onto
+func flattenColor(d GifDecoder, opt *GifOptions) color.RGBA {
+	if opt.BackgroundColor.A != 0 {
+		bg := opt.BackgroundColor
+		bg.A = 255
+		return bg
+	}
+	if gifDecoder, ok := d.(*gifDecoder); ok {
+		if bg, ok := gifDecoder.BackgroundColor(); ok {
+			return bg
+		}
+	}
+	return color.RGBA{R: 255, G: 255, B: 255, A: 255}
+}
+
+// aspectDistortion returns how much stretching a srcWidth x srcHeight image to
+// width x height distorts it, as a ratio of aspect ratios no less than 1
+func aspectDistortion(srcWidth, srcHeight, width, height int) float64 {
+	if srcWidth < 1 || srcHeight < 1 || width < 1 || height < 1 {
+		return 1
+	}
+	distortion := (float64(width) / float64(height)) / (float64(srcWidth) / float64(srcHeight))
+	if distortion < 1 {
+		distortion = 1 / distortion
+	}
+	return distortion
+}
+
+// applyScale returns opt with ScaleX and ScaleY, if set, turned into the
+// Width, Height and ResizeMethod to resize a srcWidth x srcHeight image to
+func applyScale(srcWidth, srcHeight int, opt *GifOptions) (*GifOptions, error) {
+	if opt.ScaleX == 0 && opt.ScaleY == 0 {
+		return opt, nil
+	}
+
+	scaleX, scaleY := opt.ScaleX, opt.ScaleY
+	if scaleX == 0 {
+		scaleX = 1
+	}
+	if scaleY == 0 {
+		scaleY = 1
+	}
+	if !(scaleX > 0) || !(scaleY > 0) {
+		return nil, ErrInvalidScale
+	}
+
+	scaled := *opt
+	scaled.Width = int(float64(srcWidth)*scaleX + 0.5)
+	scaled.Height = int(float64(srcHeight)*scaleY + 0.5)
+	scaled.ResizeMethod = GifOpsResize
+	return &scaled, nil
+}
+
+// reencodeOptions are the encode options that change the encoded output, so
+// an image cannot be passed through while any of them is set
+var reencodeOptions = []int{GifOutputDisposal, GifVersion, GifOptimizeFrameBounds}
+
+// needsReencode reports whether transforming an image with header h using opt
+// could produce anything other than the original image
+func needsReencode(h *ImageHeader, opt *GifOptions) bool {
+	if opt.MaxEncodeFrames != 0 || opt.MaxEncodeDuration != 0 || opt.FlattenTransparency || opt.ApplyXMPEdits || opt.EmbedProfile != "" {
+		return true
+	}
+	if opt.TreatWarningsAsErrors {
+		// warnings only surface while decoding
+		return true
+	}
+	for _, key := range reencodeOptions {
+		if _, ok := opt.EncodeOptions[key]; ok {
+			return true
+		}
+	}
+	if opt.ResizeMethod == GifOpsNoResize {
+		return false
+	}
+	// XMP edits always re-encode, so the header has the displayed size
+	width, height := outputSize(h.Width(), h.Height(), opt)
+	return h.Width() != width || h.Height() != height
+}
+
+// passThrough copies the original image data held by d into dst
+func (o *GifOps) passThrough(d GifDecoder, dst []byte) ([]byte, error) {
+	gifDecoder, ok := d.(*gifDecoder)
+	if !ok {
+		return nil, ErrGifEncoderNeedsDecoder
+	}
+	if cap(dst) < len(gifDecoder.buf) {
+		return nil, ErrBufTooSmall
+	}
+	dst = dst[:len(gifDecoder.buf)]
+	copy(dst, gifDecoder.buf)
+	return dst, nil
+}
+
+// finish applies the output size policies to the encoded image content
+func (o *GifOps) finish(d GifDecoder, h *ImageHeader, opt *GifOptions, content, dst []byte) ([]byte, error) {
+	if opt.NeverEnlargeBytes {
+		if gifDecoder, ok := d.(*gifDecoder); ok && len(content) > len(gifDecoder.buf) {
+			o.recordPassThrough(d, h)
+			return o.passThrough(d, dst)
+		}
+	}
+	return content, nil
+}
+
+// recordPassThrough notes in the manifest, if any, that the original image
+// held by d with header h was returned
+func (o *GifOps) recordPassThrough(d GifDecoder, h *ImageHeader) {
+	if o.manifest == nil {
+		return
+	}
+	infos, _ := d.FrameInfos()
+	*o.manifest = GifManifest{
+		FileType:      ".gif",
+		Width:         h.Width(),
+		Height:        h.Height(),
+		Frames:        len(infos),
+		ResizeMethod:  GifOpsNoResize.String(),
+		PassedThrough: true,
+	}
+}
+
+// Manifest returns the GifManifest of the last transform as JSON, or nil if it
+// was not a Transform run with ReturnManifest set.
+func (o *GifOps) Manifest() ([]byte, error) {
+	if o.manifest == nil {
+		return nil, nil
+	}
+	return json.Marshal(o.manifest)
+}
+
+// skipRemaining skips the rest of the frames of d, returning nil once the
+// end has been reached
+func (o *GifOps) skipRemaining(d GifDecoder) error {
+	err := o.skipToEnd(d)
+	if err != io.EOF {
+		return err
+	}
+	return nil
+}
+
 func (o *GifOps) skipToEnd(d GifDecoder) error {
 	var err error
 	for {
@@ -147,86 +595,349 @@ func (o *GifOps) skipToEnd(d GifDecoder) error {
 //
 // It is important that .Decode() not have been called already on d.
 func (o *GifOps) Transform(d GifDecoder, opt *GifOptions, dst []byte) ([]byte, error) {
-	// h, err := d.Header()
-	// if err != nil {
-	// 	return nil, err
-	// }
+	o.manifest = nil
+	content, err := o.transform(d, opt, dst)
+	if err != nil {
+		// a failed transform must not leave a partial manifest behind
+		o.manifest = nil
+		return nil, err
+	}
+	return content, nil
+}
+
+func (o *GifOps) transform(d GifDecoder, opt *GifOptions, dst []byte) ([]byte, error) {
+	h, err := d.Header()
+	if err != nil {
+		return nil, err
+	}
+	srcWidth, srcHeight := sourceSize(d, h, opt)
+
+	opt, err = applyScale(srcWidth, srcHeight, opt)
+	if err != nil {
+		return nil, err
+	}
+
+	if opt.ReturnManifest {
+		o.manifest = &GifManifest{
+			FileType:      opt.FileType,
+			EncodeOptions: opt.EncodeOptions,
+			ColorProfile:  opt.EmbedProfile,
+		}
+	}
+
+	if opt.PassThroughOptimized && !needsReencode(h, opt) {
+		o.recordPassThrough(d, h)
+		return o.passThrough(d, dst)
+	}
 
-	enc, err := NewGifEncoder(opt.FileType, d, dst)
+	content, err := withBackendThreads(opt.BackendThreads, func() ([]byte, error) {
+		return o.transcode(d, h, opt, dst)
+	})
+	if encErr, ok := err.(encodeError); ok {
+		err = encErr.err
+		if opt.RetryReducedDimensions && err == ErrInvalidImage {
+			content, err = o.retryReduced(d, h, opt, dst)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	return o.finish(d, h, opt, content, dst)
+}
+
+// retryReduced transforms the image d was created from again, scaling the
+// output down by retryScale
+func (o *GifOps) retryReduced(d GifDecoder, h *ImageHeader, opt *GifOptions, dst []byte) ([]byte, error) {
+	gifDecoder, ok := d.(*gifDecoder)
+	if !ok {
+		return nil, ErrInvalidImage
+	}
+
+	retry, err := newGifDecoder(gifDecoder.buf)
+	if err != nil {
+		return nil, err
+	}
+	defer retry.Close()
+
+	retryOpt := *opt
+	srcWidth, srcHeight := sourceSize(retry, h, opt)
+	width, height := outputSize(srcWidth, srcHeight, opt)
+	if opt.ResizeMethod == GifOpsNoResize {
+		width, height = srcWidth, srcHeight
+		retryOpt.ResizeMethod = GifOpsResize
+	}
+	retryOpt.Width = int(float64(width) * retryScale)
+	retryOpt.Height = int(float64(height) * retryScale)
+	retryOpt.DisableUpscaling = false
+
+	if opt.OnRetryReduced != nil {
+		opt.OnRetryReduced(width, height, retryOpt.Width, retryOpt.Height)
+	}
+	if o.manifest != nil {
+		o.manifest.RetriedReduced = true
+	}
+
+	content, err := withBackendThreads(opt.BackendThreads, func() ([]byte, error) {
+		return o.transcode(retry, h, &retryOpt, dst)
+	})
+	if encErr, ok := err.(encodeError); ok {
+		return nil, encErr.err
+	}
+	return content, err
+}
+
+// TransformFrames performs the requested resize operations on each frame of the
+// GifDecoder specified by d and hands the result to fn along with the frame's
+// display duration, without encoding. The Framebuffer is only valid until fn
+// returns. MaxEncodeFrames and MaxEncodeDuration limit the frames passed to fn,
+// and an error returned by fn stops the transform and is returned.
+//
+// It is important that .Decode() not have been called already on d.
+func (o *GifOps) TransformFrames(d GifDecoder, opt *GifOptions, fn func(fb *Framebuffer, dur time.Duration) error) error {
+	h, err := d.Header()
+	if err != nil {
+		return err
+	}
+	srcWidth, srcHeight := sourceSize(d, h, opt)
+
+	opt, err = applyScale(srcWidth, srcHeight, opt)
+	if err != nil {
+		return err
+	}
+
+	o.manifest = nil
+	_, err = withBackendThreads(opt.BackendThreads, func() ([]byte, error) {
+		return nil, o.eachFrame(d, h, opt, fn)
+	})
+	return err
+}
+
+// appliedXMPEdits returns the crop and orientation from the XMP packet of d
+// that opt asks to be applied. The crop is empty and the orientation
+// OrientationTopLeft if there is nothing to apply
+func appliedXMPEdits(d GifDecoder, h *ImageHeader, opt *GifOptions) (image.Rectangle, ImageOrientation) {
+	if !opt.ApplyXMPEdits {
+		return image.Rectangle{}, OrientationTopLeft
+	}
+	gifDecoder, ok := d.(*gifDecoder)
+	if !ok {
+		return image.Rectangle{}, OrientationTopLeft
+	}
+	edits := parseXMPEdits(gifXMP(gifDecoder.buf))
+	return edits.cropRect(h.Width(), h.Height()), edits.orientation
+}
+
+// transcode decodes, resizes and encodes every frame of d that opt permits
+func (o *GifOps) transcode(d GifDecoder, h *ImageHeader, opt *GifOptions, dst []byte) ([]byte, error) {
+	enc, err := o.newEncoder(opt.FileType, d, dst)
 	if err != nil {
 		return nil, err
 	}
 	defer enc.Close()
 
+	if opt.EmbedProfile != "" {
+		profile, err := namedColorProfile(opt.EmbedProfile)
+		if err != nil {
+			return nil, err
+		}
+		if gifEnc, ok := enc.(*gifEncoder); ok {
+			gifEnc.iccProfile = profile
+		}
+	}
+
+	// the edits are baked into the pixels, so a viewer must not apply them
+	// again from the XMP packet
+	if crop, orientation := appliedXMPEdits(d, h, opt); !crop.Empty() || orientation > OrientationTopLeft {
+		if gifEnc, ok := enc.(*gifEncoder); ok {
+			gifEnc.stripXMP = true
+		}
+	}
+
+	if opt.FlattenTransparency {
+		if gifEnc, ok := enc.(*gifEncoder); ok {
+			bg := flattenColor(d, opt)
+			gifEnc.paletteColor = &bg
+		}
+	}
+
+	err = o.eachFrame(d, h, opt, func(f *Framebuffer, dur time.Duration) error {
+		// the encoder only returns content once it is flushed
+		_, err := o.encode(enc, f, opt.EncodeOptions)
+		if err != nil {
+			return encodeError{err}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	content, err := o.encodeEmpty(enc, opt.EncodeOptions)
+	if err != nil {
+		return nil, encodeError{err}
+	}
+	if gifEnc, ok := enc.(*gifEncoder); ok && o.manifest != nil {
+		o.manifest.MetadataStripped = gifEnc.strippedMetadata()
+	}
+	return content, nil
+}
+
+// eachFrame decodes and resizes every frame of d that opt permits, calling fn
+// with each finished frame and its duration
+func (o *GifOps) eachFrame(d GifDecoder, h *ImageHeader, opt *GifOptions, fn func(f *Framebuffer, dur time.Duration) error) error {
+	srcWidth, srcHeight := sourceSize(d, h, opt)
+	width, height := outputSize(srcWidth, srcHeight, opt)
+	interp := resizeInterpolation(opt, width, height)
+	bg := flattenColor(d, opt)
+
+	resizeMethod := opt.ResizeMethod
+	if resizeMethod == GifOpsResize && opt.MaxAspectDistortion > 0 {
+		if aspectDistortion(srcWidth, srcHeight, width, height) > opt.MaxAspectDistortion {
+			resizeMethod = GifOpsFit
+		}
+	}
+
+	crop, orientation := appliedXMPEdits(d, h, opt)
+	if orientation.transposes() {
+		// resize to the swapped dimensions so that the frame has the
+		// requested dimensions once it has been rotated
+		width, height = height, width
+	}
+
+	if o.manifest != nil {
+		o.manifest.ResizeMethod = resizeMethod.String()
+		o.manifest.Interpolation = ""
+		if resizeMethod != GifOpsNoResize {
+			o.manifest.Interpolation = interp.String()
+		}
+		o.manifest.Frames = 0
+	}
+
 	frameCount := 0
 	duration := time.Duration(0)
 
 	for {
-		err = o.decode(d)
-		emptyFrame := false
+		err := o.decode(d, opt)
+		if err == io.EOF {
+			// we are out of frames
+			return nil
+		}
 		if err != nil {
-			if err != io.EOF {
-				return nil, err
-			}
-			// io.EOF means we are out of frames, so we should signal to Gifencoder to wrap up
-			emptyFrame = true
+			return err
 		}
 
-		duration += o.active().Duration()
+		frameDuration := o.active().Duration()
+		if frameDuration == 0 {
+			duration += opt.ZeroDurationFrameDelay
+		} else {
+			duration += frameDuration
+		}
 
 		if opt.MaxEncodeDuration != 0 && duration > opt.MaxEncodeDuration {
-			err = o.skipToEnd(d)
-			if err != io.EOF {
-				return nil, err
-			}
-			return o.encodeEmpty(enc, opt.EncodeOptions)
+			return o.skipRemaining(d)
 		}
 
-		// o.normalizeOrientation(h.Orientation())
+		if opt.FlattenTransparency {
+			o.active().Flatten(bg)
+		}
 
 		var swapped bool
-		if opt.ResizeMethod == GifOpsFit {
-			swapped, err = o.fit(d, opt.Width, opt.Height)
-		} else if opt.ResizeMethod == GifOpsResize {
-			swapped, err = o.resize(d, opt.Width, opt.Height)
+		if resizeMethod == GifOpsFit {
+			swapped, err = o.fit(d, crop, width, height, interp)
+		} else if resizeMethod == GifOpsResize {
+			swapped, err = o.resize(d, crop, width, height, interp)
+		} else if !crop.Empty() {
+			swapped, err = o.resize(d, crop, crop.Dx(), crop.Dy(), InterpolationNearestNeighbor)
 		} else {
 			swapped, err = false, nil
 		}
 
 		if err != nil {
-			return nil, err
-		}
-
-		var content []byte
-		if emptyFrame {
-			content, err = o.encodeEmpty(enc, opt.EncodeOptions)
-		} else {
-			content, err = o.encode(enc, opt.EncodeOptions)
+			return err
 		}
 
+		frame, err := o.normalizeOrientation(orientation)
 		if err != nil {
-			return nil, err
+			return err
 		}
 
-		if content != nil {
-			return content, nil
+		err = fn(frame, frameDuration)
+		if err != nil {
+			return err
 		}
 
 		frameCount++
+		if o.manifest != nil {
+			o.manifest.Width, o.manifest.Height = frame.Width(), frame.Height()
+			o.manifest.Frames = frameCount
+		}
 
 		if opt.MaxEncodeFrames != 0 && frameCount == opt.MaxEncodeFrames {
-			err = o.skipToEnd(d)
-			if err != io.EOF {
-				return nil, err
-			}
-			return o.encodeEmpty(enc, opt.EncodeOptions)
+			return o.skipRemaining(d)
 		}
 
-		// content == nil and err == nil -- this is Gifencoder telling us to do another frame
-
 		// for mulitple frames/gifs we need the decoded frame to be active again
 		if swapped {
 			o.swap()
 		}
 	}
 }
+
+// GeneratePlaceholder writes a width x height image of the solid color c into
+// dst, encoded as fileType with the encode options opt. Only ".gif" output is
+// supported. A new slice pointing to dst is returned with its length set to the
+// length of the resulting image. Returns ErrInvalidDimensions if width or
+// height is less than 1, and ErrDimensionsTooLarge if either is larger than
+// a GIF can hold or than SetGIFMaxFrameDimension allows.
+func GeneratePlaceholder(width, height int, c color.RGBA, fileType string, opt map[int]int, dst []byte) ([]byte, error) {
+	if fileType != ".gif" {
+		return nil, ErrUnsupportedFileType
+	}
+
+	if width < 1 || height < 1 {
+		return nil, ErrInvalidDimensions
+	}
+	maxDim := atomic.LoadUint64(&gifMaxFrameDimension)
+	if maxDim > gifMaxScreenDimension {
+		maxDim = gifMaxScreenDimension
+	}
+	if uint64(width) > maxDim || uint64(height) > maxDim {
+		return nil, ErrDimensionsTooLarge
+	}
+
+	// the GIF encoder takes its palette from a decoder, so build a single
+	// pixel GIF of the color and stretch it to size
+	var src bytes.Buffer
+	pixel := image.NewPaletted(image.Rect(0, 0, 1, 1), color.Palette{c})
+	if err := gif.Encode(&src, pixel, nil); err != nil {
+		return nil, err
+	}
+
+	d, err := NewGifDecoder(src.Bytes())
+	if err != nil {
+		return nil, err
+	}
+	defer d.Close()
+
+	// only the output is large, so size the frames to it rather than to a
+	// square that fits either side
+	maxSize := width
+	if height > maxSize {
+		maxSize = height
+	}
+	ops := &GifOps{
+		frames:     []*Framebuffer{NewFramebuffer(width, height), NewFramebuffer(width, height)},
+		maxSize:    maxSize,
+		newEncoder: NewGifEncoder,
+	}
+	defer ops.Close()
+
+	return ops.Transform(d, &GifOptions{
+		FileType:      fileType,
+		Width:         width,
+		Height:        height,
+		ResizeMethod:  GifOpsResize,
+		EncodeOptions: opt,
+	}, dst)
+}
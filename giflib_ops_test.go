@@ -0,0 +1,1217 @@
+package gocv
+
+import (
+	"bytes"
+	"encoding/json"
+	"image"
+	"image/color"
+	"image/gif"
+	"testing"
+	"time"
+)
+
+var testGifPalette = color.Palette{
+	color.RGBA{0, 0, 0, 255},
+	color.RGBA{255, 255, 255, 255},
+	color.RGBA{255, 0, 0, 255},
+	color.RGBA{0, 255, 0, 255},
+	color.RGBA{0, 0, 255, 255},
+	color.RGBA{0, 0, 0, 0},
+}
+
+// newTestGifFrame returns a width x height frame filled with palette entry index
+func newTestGifFrame(width, height int, index uint8) *image.Paletted {
+	frame := image.NewPaletted(image.Rect(0, 0, width, height), testGifPalette)
+	for i := range frame.Pix {
+		frame.Pix[i] = index
+	}
+	return frame
+}
+
+// newTestGif encodes frames as an animated GIF with each frame shown for
+// delay hundredths of a second
+func newTestGif(t *testing.T, frames []*image.Paletted, delay int) []byte {
+	g := &gif.GIF{}
+	for _, frame := range frames {
+		g.Image = append(g.Image, frame)
+		g.Delay = append(g.Delay, delay)
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("failed to build test GIF: %v", err)
+	}
+	return buf.Bytes()
+}
+
+// transformTestGif runs src through a fresh GifOps with opt
+func transformTestGif(t *testing.T, src []byte, opt *GifOptions) []byte {
+	d, err := NewGifDecoder(src)
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+
+	ops := NewGifOps(1024)
+	defer ops.Close()
+
+	out, err := ops.Transform(d, opt, make([]byte, 10*1024*1024))
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	return out
+}
+
+func TestGifOpsPassThroughOptimized(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(64, 64, 2)}, 0)
+
+	out := transformTestGif(t, src, &GifOptions{
+		FileType:             ".gif",
+		Width:                64,
+		Height:               64,
+		ResizeMethod:         GifOpsFit,
+		PassThroughOptimized: true,
+	})
+	if !bytes.Equal(out, src) {
+		t.Error("Transform should pass through an input already at the requested size")
+	}
+
+	out = transformTestGif(t, src, &GifOptions{
+		FileType:             ".gif",
+		Width:                32,
+		Height:               32,
+		ResizeMethod:         GifOpsFit,
+		PassThroughOptimized: true,
+	})
+	if bytes.Equal(out, src) {
+		t.Error("Transform should re-encode an input that needs resizing")
+	}
+}
+
+func TestGifOpsNeverEnlargeBytes(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(16, 16, 2)}, 0)
+
+	out := transformTestGif(t, src, &GifOptions{
+		FileType:          ".gif",
+		Width:             256,
+		Height:            256,
+		ResizeMethod:      GifOpsResize,
+		NeverEnlargeBytes: true,
+	})
+	if !bytes.Equal(out, src) {
+		t.Error("Transform should return the original when the result would be larger")
+	}
+}
+
+func TestGifOpsMinUpscaleBelow(t *testing.T) {
+	tests := []struct {
+		width, height             int
+		targetWidth, targetHeight int
+		expectedWidth             int
+		expectedHeight            int
+	}{
+		{16, 16, 64, 64, 64, 64},
+		{200, 200, 400, 400, 200, 200},
+		// scaling down to fit would leave the height under a pixel
+		{1, 100, 200, 10, 1, 1},
+	}
+
+	for _, test := range tests {
+		src := newTestGif(t, []*image.Paletted{newTestGifFrame(test.width, test.height, 2)}, 0)
+		out := transformTestGif(t, src, &GifOptions{
+			FileType:         ".gif",
+			Width:            test.targetWidth,
+			Height:           test.targetHeight,
+			ResizeMethod:     GifOpsFit,
+			DisableUpscaling: true,
+			MinUpscaleBelow:  32,
+		})
+
+		cfg, err := gif.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("failed to read transformed GIF: %v", err)
+		}
+		if cfg.Width != test.expectedWidth || cfg.Height != test.expectedHeight {
+			t.Errorf("%dx%d source: expected %dx%d output, got %dx%d",
+				test.width, test.height, test.expectedWidth, test.expectedHeight, cfg.Width, cfg.Height)
+		}
+	}
+}
+
+func TestGifOpsAdaptiveResizeQuality(t *testing.T) {
+	opt := &GifOptions{ResizeQuality: GifOpsResizeQualityAdaptive, AdaptiveThreshold: 64}
+
+	tests := []struct {
+		width, height int
+		expected      InterpolationFlags
+	}{
+		{16, 16, InterpolationNearestNeighbor},
+		{63, 63, InterpolationNearestNeighbor},
+		{64, 32, InterpolationLanczos4},
+		{64, 64, InterpolationLanczos4},
+		{256, 256, InterpolationLanczos4},
+	}
+
+	for _, test := range tests {
+		interp := resizeInterpolation(opt, test.width, test.height)
+		if interp != test.expected {
+			t.Errorf("%dx%d: expected %v, got %v", test.width, test.height, test.expected, interp)
+		}
+	}
+
+	if interp := resizeInterpolation(&GifOptions{ResizeQuality: GifOpsResizeQualityAdaptive}, 31, 31); interp != InterpolationNearestNeighbor {
+		t.Errorf("default threshold: expected %v, got %v", InterpolationNearestNeighbor, interp)
+	}
+
+	if interp := resizeInterpolation(&GifOptions{}, 16, 16); interp != InterpolationArea {
+		t.Errorf("default quality: expected %v, got %v", InterpolationArea, interp)
+	}
+}
+
+func TestGifOpsTreatWarningsAsErrors(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(8, 8, 2)}, 0)
+	// shrink the logical screen so that the frame hangs off its edges
+	src[6], src[7], src[8], src[9] = 4, 0, 4, 0
+
+	opt := &GifOptions{
+		FileType:     ".gif",
+		Width:        4,
+		Height:       4,
+		ResizeMethod: GifOpsResize,
+	}
+	transformTestGif(t, src, opt)
+
+	d, err := NewGifDecoder(src)
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+
+	ops := NewGifOps(64)
+	defer ops.Close()
+
+	opt.TreatWarningsAsErrors = true
+	_, err = ops.Transform(d, opt, make([]byte, 1024*1024))
+	if err != ErrGifFrameOutOfBounds {
+		t.Errorf("expected %v under strict mode, got %v", ErrGifFrameOutOfBounds, err)
+	}
+
+	// an input already at the requested size must still be checked
+	d, err = NewGifDecoder(src)
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+
+	opt.PassThroughOptimized = true
+	_, err = ops.Transform(d, opt, make([]byte, 1024*1024))
+	if err != ErrGifFrameOutOfBounds {
+		t.Errorf("expected %v under strict mode with pass through, got %v", ErrGifFrameOutOfBounds, err)
+	}
+}
+
+func TestGifOpsOutputDisposal(t *testing.T) {
+	frames := []*image.Paletted{
+		newTestGifFrame(16, 16, 2),
+		newTestGifFrame(16, 16, 3),
+		newTestGifFrame(16, 16, 4),
+	}
+	src := newTestGif(t, frames, 10)
+
+	for _, size := range []int{8, 16} {
+		// at 16x16 the input is already the requested size
+		out := transformTestGif(t, src, &GifOptions{
+			FileType:             ".gif",
+			Width:                size,
+			Height:               size,
+			ResizeMethod:         GifOpsResize,
+			PassThroughOptimized: true,
+			EncodeOptions:        map[int]int{GifOutputDisposal: int(GifDisposalBackground)},
+		})
+
+		g, err := gif.DecodeAll(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%dx%d: failed to read transformed GIF: %v", size, size, err)
+		}
+		if len(g.Disposal) != len(frames) {
+			t.Fatalf("%dx%d: expected %d frames, got %d", size, size, len(frames), len(g.Disposal))
+		}
+		for i, disposal := range g.Disposal {
+			if GifDisposal(disposal) != GifDisposalBackground {
+				t.Errorf("%dx%d: frame %d: expected disposal %d, got %d", size, size, i, GifDisposalBackground, disposal)
+			}
+		}
+	}
+
+	// options meant for other encoders must not change the output
+	out := transformTestGif(t, src, &GifOptions{
+		FileType:             ".gif",
+		Width:                16,
+		Height:               16,
+		ResizeMethod:         GifOpsResize,
+		PassThroughOptimized: true,
+		EncodeOptions:        map[int]int{IMWriteJpegQuality: 85},
+	})
+	if !bytes.Equal(out, src) {
+		t.Error("expected IMWriteJpegQuality to leave the input to pass through")
+	}
+
+	d, err := NewGifDecoder(src)
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+	ops := NewGifOps(64)
+	defer ops.Close()
+	_, err = ops.Transform(d, &GifOptions{
+		FileType:      ".gif",
+		Width:         8,
+		Height:        8,
+		ResizeMethod:  GifOpsResize,
+		EncodeOptions: map[int]int{GifOutputDisposal: 85},
+	}, make([]byte, 1024*1024))
+	if err != ErrInvalidGifDisposal {
+		t.Errorf("expected %v for disposal 85, got %v", ErrInvalidGifDisposal, err)
+	}
+}
+
+func TestGifOpsFlattenTransparency(t *testing.T) {
+	// left half transparent, right half red
+	frame := newTestGifFrame(16, 16, 2)
+	for y := 0; y < 16; y++ {
+		for x := 0; x < 8; x++ {
+			frame.SetColorIndex(x, y, 5)
+		}
+	}
+
+	// the background index is only written along with a global palette
+	g := &gif.GIF{
+		Image:           []*image.Paletted{frame},
+		Delay:           []int{0},
+		BackgroundIndex: 3,
+		Config:          image.Config{ColorModel: testGifPalette, Width: 16, Height: 16},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("failed to build test GIF: %v", err)
+	}
+
+	tests := []struct {
+		name       string
+		background color.RGBA
+		expected   color.RGBA
+	}{
+		{"chosen color", color.RGBA{0, 0, 255, 255}, color.RGBA{0, 0, 255, 255}},
+		{"gif background index", color.RGBA{}, color.RGBA{0, 255, 0, 255}},
+		{"color missing from palette", color.RGBA{128, 64, 200, 255}, color.RGBA{128, 64, 200, 255}},
+	}
+
+	for _, test := range tests {
+		out := transformTestGif(t, buf.Bytes(), &GifOptions{
+			FileType:            ".gif",
+			Width:               16,
+			Height:              16,
+			ResizeMethod:        GifOpsResize,
+			FlattenTransparency: true,
+			BackgroundColor:     test.background,
+		})
+
+		img, err := gif.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: failed to read transformed GIF: %v", test.name, err)
+		}
+		if got := color.RGBAModel.Convert(img.At(2, 8)); got != test.expected {
+			t.Errorf("%s: expected flattened pixel %v, got %v", test.name, test.expected, got)
+		}
+		if got := color.RGBAModel.Convert(img.At(13, 8)); got != (color.RGBA{255, 0, 0, 255}) {
+			t.Errorf("%s: expected opaque pixel to stay red, got %v", test.name, got)
+		}
+	}
+}
+
+// withTestGifXMP embeds xmp in src as an XMP application extension, using the
+// raw layout and magic trailer from the XMP specification
+func withTestGifXMP(src []byte, xmp string) []byte {
+	ext := []byte{0x21, 0xff, 0x0b}
+	ext = append(ext, "XMP DataXMP"...)
+	ext = append(ext, xmp...)
+	ext = append(ext, 0x01)
+	for i := 0xff; i >= 0; i-- {
+		ext = append(ext, byte(i))
+	}
+	ext = append(ext, 0x00)
+
+	offset := 13
+	if src[10]&0x80 != 0 {
+		offset += 3 * (1 << ((src[10] & 0x07) + 1))
+	}
+
+	out := append([]byte{}, src[:offset]...)
+	out = append(out, ext...)
+	return append(out, src[offset:]...)
+}
+
+func TestGifOpsApplyXMPEdits(t *testing.T) {
+	// 40x20, left half red, right half green on top and blue on the bottom
+	frame := newTestGifFrame(40, 20, 2)
+	for y := 0; y < 20; y++ {
+		for x := 20; x < 40; x++ {
+			if y < 10 {
+				frame.SetColorIndex(x, y, 3)
+			} else {
+				frame.SetColorIndex(x, y, 4)
+			}
+		}
+	}
+	src := withTestGifXMP(newTestGif(t, []*image.Paletted{frame}, 0), `<x:xmpmeta xmlns:x="adobe:ns:meta/">
+<rdf:RDF xmlns:rdf="http://www.w3.org/1999/02/22-rdf-syntax-ns#">
+<rdf:Description rdf:about=""
+ xmlns:tiff="http://ns.adobe.com/tiff/1.0/"
+ xmlns:crs="http://ns.adobe.com/camera-raw-settings/1.0/"
+ tiff:Orientation="6"
+ crs:HasCrop="True"
+ crs:CropLeft="0.5"
+ crs:CropTop="0"
+ crs:CropRight="1"
+ crs:CropBottom="1"/>
+</rdf:RDF>
+</x:xmpmeta>`)
+
+	out := transformTestGif(t, src, &GifOptions{FileType: ".gif"})
+	cfg, err := gif.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to read transformed GIF: %v", err)
+	}
+	if cfg.Width != 40 || cfg.Height != 20 {
+		t.Errorf("XMP edits should be ignored by default, got %dx%d", cfg.Width, cfg.Height)
+	}
+	if gifXMP(out) == nil {
+		t.Error("expected the XMP packet to be kept when its edits are not applied")
+	}
+
+	out = transformTestGif(t, src, &GifOptions{FileType: ".gif", ApplyXMPEdits: true})
+	img, err := gif.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to read transformed GIF: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 20 || b.Dy() != 20 {
+		t.Fatalf("expected 20x20 cropped output, got %dx%d", b.Dx(), b.Dy())
+	}
+
+	// rotating clockwise moves the green top half to the right
+	green, blue := color.RGBA{0, 255, 0, 255}, color.RGBA{0, 0, 255, 255}
+	if got := color.RGBAModel.Convert(img.At(15, 10)); got != green {
+		t.Errorf("expected right half to be green, got %v", got)
+	}
+	if got := color.RGBAModel.Convert(img.At(4, 10)); got != blue {
+		t.Errorf("expected left half to be blue, got %v", got)
+	}
+
+	// the edits are already applied, so they must not be passed on
+	if edits := parseXMPEdits(gifXMP(out)); edits.hasCrop || edits.orientation != OrientationTopLeft {
+		t.Errorf("expected output XMP to carry no edits, got %+v", edits)
+	}
+}
+
+func TestGeneratePlaceholder(t *testing.T) {
+	red := color.RGBA{255, 0, 0, 255}
+	out, err := GeneratePlaceholder(100, 100, red, ".gif", nil, make([]byte, 1024*1024))
+	if err != nil {
+		t.Fatalf("GeneratePlaceholder failed: %v", err)
+	}
+
+	img, err := gif.Decode(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to read placeholder: %v", err)
+	}
+	if b := img.Bounds(); b.Dx() != 100 || b.Dy() != 100 {
+		t.Errorf("expected 100x100 placeholder, got %dx%d", b.Dx(), b.Dy())
+	}
+	for _, p := range []image.Point{{0, 0}, {50, 50}, {99, 99}} {
+		if got := color.RGBAModel.Convert(img.At(p.X, p.Y)); got != red {
+			t.Errorf("pixel %v: expected %v, got %v", p, red, got)
+		}
+	}
+
+	if _, err := GeneratePlaceholder(100, 100, red, ".jpeg", nil, make([]byte, 1024)); err != ErrUnsupportedFileType {
+		t.Errorf("expected %v for JPEG placeholder, got %v", ErrUnsupportedFileType, err)
+	}
+
+	for _, size := range [][2]int{{0, 0}, {100, 0}, {-1, 100}} {
+		if _, err := GeneratePlaceholder(size[0], size[1], red, ".gif", nil, make([]byte, 1024)); err != ErrInvalidDimensions {
+			t.Errorf("%dx%d: expected %v, got %v", size[0], size[1], ErrInvalidDimensions, err)
+		}
+	}
+
+	for _, size := range [][2]int{{65536, 1}, {1, 1 << 30}, {defaultMaxFrameDimension + 1, 1}} {
+		if _, err := GeneratePlaceholder(size[0], size[1], red, ".gif", nil, make([]byte, 1024)); err != ErrDimensionsTooLarge {
+			t.Errorf("%dx%d: expected %v, got %v", size[0], size[1], ErrDimensionsTooLarge, err)
+		}
+	}
+
+	// a long thin placeholder only needs buffers for its own area
+	out, err = GeneratePlaceholder(defaultMaxFrameDimension, 1, red, ".gif", nil, make([]byte, 1024*1024))
+	if err != nil {
+		t.Fatalf("GeneratePlaceholder failed for a %dx1 image: %v", defaultMaxFrameDimension, err)
+	}
+	cfg, err := gif.DecodeConfig(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to decode output: %v", err)
+	}
+	if cfg.Width != defaultMaxFrameDimension || cfg.Height != 1 {
+		t.Errorf("expected %dx1, got %dx%d", defaultMaxFrameDimension, cfg.Width, cfg.Height)
+	}
+}
+
+func TestGifOpsMaxAspectDistortion(t *testing.T) {
+	// top quarter red, the rest blue
+	frame := newTestGifFrame(100, 100, 4)
+	for y := 0; y < 25; y++ {
+		for x := 0; x < 100; x++ {
+			frame.SetColorIndex(x, y, 2)
+		}
+	}
+	src := newTestGif(t, []*image.Paletted{frame}, 0)
+
+	tests := []struct {
+		name          string
+		maxDistortion float64
+		expected      color.RGBA
+	}{
+		// stretching keeps the red band at the top
+		{"within cap", 10, color.RGBA{255, 0, 0, 255}},
+		// fitting crops to the vertical center, which is all blue
+		{"beyond cap", 2, color.RGBA{0, 0, 255, 255}},
+	}
+
+	for _, test := range tests {
+		out := transformTestGif(t, src, &GifOptions{
+			FileType:            ".gif",
+			Width:               400,
+			Height:              50,
+			ResizeMethod:        GifOpsResize,
+			MaxAspectDistortion: test.maxDistortion,
+		})
+
+		img, err := gif.Decode(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: failed to read transformed GIF: %v", test.name, err)
+		}
+		if b := img.Bounds(); b.Dx() != 400 || b.Dy() != 50 {
+			t.Errorf("%s: expected 400x50 output, got %dx%d", test.name, b.Dx(), b.Dy())
+		}
+		if got := color.RGBAModel.Convert(img.At(200, 2)); got != test.expected {
+			t.Errorf("%s: expected top row %v, got %v", test.name, test.expected, got)
+		}
+	}
+}
+
+func TestGifOpsTransformFrames(t *testing.T) {
+	frames := []*image.Paletted{
+		newTestGifFrame(32, 16, 2),
+		newTestGifFrame(32, 16, 3),
+		newTestGifFrame(32, 16, 4),
+	}
+	src := newTestGif(t, frames, 10)
+
+	tests := []struct {
+		name      string
+		maxFrames int
+		expected  int
+	}{
+		{"all frames", 0, 3},
+		{"frame limit", 2, 2},
+	}
+
+	for _, test := range tests {
+		d, err := NewGifDecoder(src)
+		if err != nil {
+			t.Fatalf("NewGifDecoder failed: %v", err)
+		}
+
+		ops := NewGifOps(64)
+		calls := 0
+		err = ops.TransformFrames(d, &GifOptions{
+			Width:           16,
+			Height:          8,
+			ResizeMethod:    GifOpsResize,
+			MaxEncodeFrames: test.maxFrames,
+		}, func(fb *Framebuffer, dur time.Duration) error {
+			calls++
+			if fb.Width() != 16 || fb.Height() != 8 {
+				t.Errorf("%s: expected 16x8 frame, got %dx%d", test.name, fb.Width(), fb.Height())
+			}
+			if dur != 100*time.Millisecond {
+				t.Errorf("%s: expected 100ms frame duration, got %v", test.name, dur)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: TransformFrames failed: %v", test.name, err)
+		}
+		if calls != test.expected {
+			t.Errorf("%s: expected %d callbacks, got %d", test.name, test.expected, calls)
+		}
+
+		ops.Close()
+		d.Close()
+	}
+}
+
+func TestGifOpsZeroDurationFrames(t *testing.T) {
+	var frames []*image.Paletted
+	for i := 0; i < 6; i++ {
+		frames = append(frames, newTestGifFrame(16, 16, uint8(i%5)))
+	}
+	src := newTestGif(t, frames, 0)
+
+	tests := []struct {
+		name      string
+		maxFrames int
+		zeroDelay time.Duration
+		expected  int
+	}{
+		{"duration limit alone", 0, 0, 6},
+		{"frame count fallback", 3, 0, 3},
+		{"zero duration frame delay", 0, 50 * time.Millisecond, 2},
+		{"frame count before duration", 1, 50 * time.Millisecond, 1},
+	}
+
+	for _, test := range tests {
+		d, err := NewGifDecoder(src)
+		if err != nil {
+			t.Fatalf("NewGifDecoder failed: %v", err)
+		}
+
+		ops := NewGifOps(64)
+		calls := 0
+		err = ops.TransformFrames(d, &GifOptions{
+			MaxEncodeDuration:      100 * time.Millisecond,
+			MaxEncodeFrames:        test.maxFrames,
+			ZeroDurationFrameDelay: test.zeroDelay,
+		}, func(fb *Framebuffer, dur time.Duration) error {
+			calls++
+			if dur != 0 {
+				t.Errorf("%s: expected output delay to stay 0, got %v", test.name, dur)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Errorf("%s: TransformFrames failed: %v", test.name, err)
+		}
+		if calls != test.expected {
+			t.Errorf("%s: expected %d frames, got %d", test.name, test.expected, calls)
+		}
+
+		ops.Close()
+		d.Close()
+	}
+}
+
+func TestGifOpsGifVersion(t *testing.T) {
+	static := newTestGif(t, []*image.Paletted{newTestGifFrame(16, 16, 2)}, 0)
+	animated := newTestGif(t, []*image.Paletted{newTestGifFrame(16, 16, 2), newTestGifFrame(16, 16, 3)}, 10)
+	transparent := newTestGif(t, []*image.Paletted{newTestGifFrame(16, 16, 5)}, 0)
+
+	tests := []struct {
+		name     string
+		src      []byte
+		expected string
+	}{
+		{"static", static, "GIF87a"},
+		{"animated", animated, "GIF89a"},
+		{"transparent", transparent, "GIF89a"},
+	}
+
+	for _, test := range tests {
+		out := transformTestGif(t, test.src, &GifOptions{
+			FileType:      ".gif",
+			Width:         8,
+			Height:        8,
+			ResizeMethod:  GifOpsResize,
+			EncodeOptions: map[int]int{GifVersion: GifVersion87a},
+		})
+
+		if !bytes.HasPrefix(out, []byte(test.expected)) {
+			t.Errorf("%s: expected %s signature, got %q", test.name, test.expected, out[:6])
+		}
+		if _, err := gif.DecodeAll(bytes.NewReader(out)); err != nil {
+			t.Errorf("%s: failed to read transformed GIF: %v", test.name, err)
+		}
+	}
+	// the 16x16 input is already at the requested size but is GIF89a
+	out := transformTestGif(t, static, &GifOptions{
+		FileType:             ".gif",
+		Width:                16,
+		Height:               16,
+		ResizeMethod:         GifOpsResize,
+		PassThroughOptimized: true,
+		EncodeOptions:        map[int]int{GifVersion: GifVersion87a},
+	})
+	if !bytes.HasPrefix(out, []byte("GIF87a")) {
+		t.Errorf("pass through: expected GIF87a signature, got %q", out[:6])
+	}
+}
+
+// failingGifEncoder fails the first failures calls to Encode and delegates to
+// the wrapped encoder after that
+type failingGifEncoder struct {
+	GifEncoder
+	failures *int
+}
+
+func (e *failingGifEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
+	if *e.failures > 0 {
+		*e.failures--
+		return nil, ErrInvalidImage
+	}
+	return e.GifEncoder.Encode(f, opt)
+}
+
+// threadRecordingGifEncoder records OpenCV's thread count on each Encode
+type threadRecordingGifEncoder struct {
+	GifEncoder
+	threads *[]int
+}
+
+func (e *threadRecordingGifEncoder) Encode(f *Framebuffer, opt map[int]int) ([]byte, error) {
+	*e.threads = append(*e.threads, BackendThreads())
+	return e.GifEncoder.Encode(f, opt)
+}
+
+func TestGifOpsBackendThreads(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(32, 32, 2), newTestGifFrame(32, 32, 3)}, 10)
+	prev := BackendThreads()
+
+	d, err := NewGifDecoder(src)
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+
+	var threads []int
+	ops := NewGifOps(64)
+	defer ops.Close()
+	ops.newEncoder = func(ext string, decodedBy GifDecoder, dst []byte) (GifEncoder, error) {
+		enc, err := NewGifEncoder(ext, decodedBy, dst)
+		if err != nil {
+			return nil, err
+		}
+		return &threadRecordingGifEncoder{GifEncoder: enc, threads: &threads}, nil
+	}
+
+	_, err = ops.Transform(d, &GifOptions{
+		FileType:       ".gif",
+		Width:          16,
+		Height:         16,
+		ResizeMethod:   GifOpsResize,
+		BackendThreads: 1,
+	}, make([]byte, 1024*1024))
+	if err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+
+	// two frames and the final flush
+	if len(threads) != 3 {
+		t.Fatalf("expected 3 encode calls, got %d", len(threads))
+	}
+	for i, n := range threads {
+		if n != 1 {
+			t.Errorf("encode call %d: expected 1 backend thread, got %d", i, n)
+		}
+	}
+	if after := BackendThreads(); after != prev {
+		t.Errorf("expected backend threads to be restored to %d, got %d", prev, after)
+	}
+}
+
+func TestGifOpsRetryReducedDimensions(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(100, 100, 2)}, 0)
+
+	for _, retry := range []bool{false, true} {
+		d, err := NewGifDecoder(src)
+		if err != nil {
+			t.Fatalf("NewGifDecoder failed: %v", err)
+		}
+
+		failures := 1
+		ops := NewGifOps(128)
+		ops.newEncoder = func(ext string, decodedBy GifDecoder, dst []byte) (GifEncoder, error) {
+			enc, err := NewGifEncoder(ext, decodedBy, dst)
+			if err != nil {
+				return nil, err
+			}
+			return &failingGifEncoder{GifEncoder: enc, failures: &failures}, nil
+		}
+
+		var retries [][4]int
+		out, err := ops.Transform(d, &GifOptions{
+			FileType:               ".gif",
+			Width:                  100,
+			Height:                 100,
+			ResizeMethod:           GifOpsResize,
+			RetryReducedDimensions: retry,
+			ReturnManifest:         true,
+			OnRetryReduced: func(width, height, retryWidth, retryHeight int) {
+				retries = append(retries, [4]int{width, height, retryWidth, retryHeight})
+			},
+		}, make([]byte, 1024*1024))
+
+		if !retry {
+			if err != ErrInvalidImage {
+				t.Errorf("without retry: expected %v, got %v", ErrInvalidImage, err)
+			}
+			if blob, _ := ops.Manifest(); blob != nil {
+				t.Errorf("without retry: expected no manifest after a failed transform, got %s", blob)
+			}
+			if len(retries) != 0 {
+				t.Errorf("without retry: expected no retry to be reported, got %v", retries)
+			}
+		} else if err != nil {
+			t.Errorf("with retry: Transform failed: %v", err)
+		} else {
+			cfg, err := gif.DecodeConfig(bytes.NewReader(out))
+			if err != nil {
+				t.Fatalf("failed to read transformed GIF: %v", err)
+			}
+			if cfg.Width != 90 || cfg.Height != 90 {
+				t.Errorf("expected retry at 90x90, got %dx%d", cfg.Width, cfg.Height)
+			}
+
+			blob, err := ops.Manifest()
+			if err != nil {
+				t.Fatalf("Manifest failed: %v", err)
+			}
+			var manifest GifManifest
+			if err := json.Unmarshal(blob, &manifest); err != nil {
+				t.Fatalf("manifest is not valid JSON: %v", err)
+			}
+			if !manifest.RetriedReduced {
+				t.Error("expected the manifest to record the retry")
+			}
+			if len(retries) != 1 || retries[0] != [4]int{100, 100, 90, 90} {
+				t.Errorf("expected one retry from 100x100 to 90x90 to be reported, got %v", retries)
+			}
+		}
+
+		ops.Close()
+		d.Close()
+	}
+}
+
+func TestGifOpsEmbedProfile(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(16, 16, 2)}, 0)
+
+	for _, name := range []string{ColorProfileSRGB, ColorProfileDisplayP3} {
+		out := transformTestGif(t, src, &GifOptions{
+			FileType:     ".gif",
+			Width:        8,
+			Height:       8,
+			ResizeMethod: GifOpsResize,
+			EmbedProfile: name,
+		})
+
+		// reassemble the sub-blocks of the ICC application extension
+		var embedded []byte
+		err := walkGifBlocks(out, func(block []byte) {
+			if block[0] != 0x21 || block[1] != 0xff || !bytes.HasPrefix(block[2:], []byte("\x0bICCRGBG1012")) {
+				return
+			}
+			for i := 2 + 12; block[i] != 0; i += int(block[i]) + 1 {
+				embedded = append(embedded, block[i+1:i+1+int(block[i])]...)
+			}
+		})
+		if err != nil {
+			t.Fatalf("%s: failed to walk transformed GIF: %v", name, err)
+		}
+
+		profile, err := namedColorProfile(name)
+		if err != nil {
+			t.Fatalf("%s: namedColorProfile failed: %v", name, err)
+		}
+		if !bytes.Equal(embedded, profile) {
+			t.Errorf("%s: embedded profile does not match, got %d bytes, expected %d", name, len(embedded), len(profile))
+		}
+		if !bytes.Equal(profile[36:40], []byte("acsp")) {
+			t.Errorf("%s: profile is missing its ICC signature", name)
+		}
+		if _, err := gif.DecodeAll(bytes.NewReader(out)); err != nil {
+			t.Errorf("%s: failed to read transformed GIF: %v", name, err)
+		}
+	}
+
+	d, err := NewGifDecoder(src)
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+	ops := NewGifOps(64)
+	defer ops.Close()
+	_, err = ops.Transform(d, &GifOptions{FileType: ".gif", EmbedProfile: "Adobe RGB"}, make([]byte, 1024*1024))
+	if err != ErrUnknownColorProfile {
+		t.Errorf("expected %v for an unknown profile, got %v", ErrUnknownColorProfile, err)
+	}
+}
+
+func TestGifOpsReturnManifest(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(64, 64, 2), newTestGifFrame(64, 64, 3)}, 10)
+
+	tests := []struct {
+		name     string
+		opt      *GifOptions
+		expected GifManifest
+	}{
+		{
+			"resize",
+			&GifOptions{
+				FileType:      ".gif",
+				Width:         48,
+				Height:        16,
+				ResizeMethod:  GifOpsResize,
+				ResizeQuality: GifOpsResizeQualityAdaptive,
+				EncodeOptions: map[int]int{GifVersion: GifVersion89a},
+				EmbedProfile:  ColorProfileSRGB,
+			},
+			GifManifest{
+				FileType:      ".gif",
+				Width:         48,
+				Height:        16,
+				Frames:        2,
+				ResizeMethod:  "resize",
+				Interpolation: InterpolationLanczos4.String(),
+				EncodeOptions: map[int]int{GifVersion: GifVersion89a},
+				ColorProfile:  ColorProfileSRGB,
+			},
+		},
+		{
+			"fit with frame limit",
+			&GifOptions{FileType: ".gif", Width: 16, Height: 16, ResizeMethod: GifOpsFit, MaxEncodeFrames: 1},
+			GifManifest{FileType: ".gif", Width: 16, Height: 16, Frames: 1, ResizeMethod: "fit", Interpolation: InterpolationArea.String()},
+		},
+		{
+			"pass through",
+			&GifOptions{FileType: ".gif", Width: 64, Height: 64, ResizeMethod: GifOpsFit, PassThroughOptimized: true},
+			GifManifest{FileType: ".gif", Width: 64, Height: 64, Frames: 2, ResizeMethod: "no-resize", PassedThrough: true},
+		},
+	}
+
+	for _, test := range tests {
+		d, err := NewGifDecoder(src)
+		if err != nil {
+			t.Fatalf("NewGifDecoder failed: %v", err)
+		}
+		ops := NewGifOps(128)
+
+		test.opt.ReturnManifest = true
+		if _, err := ops.Transform(d, test.opt, make([]byte, 1024*1024)); err != nil {
+			t.Fatalf("%s: Transform failed: %v", test.name, err)
+		}
+		blob, err := ops.Manifest()
+		if err != nil {
+			t.Fatalf("%s: Manifest failed: %v", test.name, err)
+		}
+
+		var got GifManifest
+		if err := json.Unmarshal(blob, &got); err != nil {
+			t.Fatalf("%s: manifest is not valid JSON: %v", test.name, err)
+		}
+		if got.FileType != test.expected.FileType || got.Width != test.expected.Width || got.Height != test.expected.Height ||
+			got.Frames != test.expected.Frames || got.ResizeMethod != test.expected.ResizeMethod ||
+			got.Interpolation != test.expected.Interpolation || got.ColorProfile != test.expected.ColorProfile ||
+			got.PassedThrough != test.expected.PassedThrough || got.RetriedReduced != test.expected.RetriedReduced ||
+			got.MetadataStripped != test.expected.MetadataStripped || len(got.EncodeOptions) != len(test.expected.EncodeOptions) {
+			t.Errorf("%s: expected manifest %+v, got %+v", test.name, test.expected, got)
+		}
+		for k, v := range test.expected.EncodeOptions {
+			if got.EncodeOptions[k] != v {
+				t.Errorf("%s: expected encode option %d to be %d, got %d", test.name, k, v, got.EncodeOptions[k])
+			}
+		}
+
+		ops.Close()
+		d.Close()
+	}
+
+	// without the option there is nothing to report
+	d, err := NewGifDecoder(src)
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+	ops := NewGifOps(128)
+	defer ops.Close()
+	if _, err := ops.Transform(d, &GifOptions{FileType: ".gif", Width: 32, Height: 32, ResizeMethod: GifOpsResize}, make([]byte, 1024*1024)); err != nil {
+		t.Fatalf("Transform failed: %v", err)
+	}
+	if blob, _ := ops.Manifest(); blob != nil {
+		t.Errorf("expected no manifest without ReturnManifest, got %s", blob)
+	}
+
+	// the XMP packet is only left out once its edits are applied
+	xmpSrc := withTestGifXMP(newTestGif(t, []*image.Paletted{newTestGifFrame(64, 32, 2)}, 0),
+		`<rdf:Description tiff:Orientation="6"/>`)
+	for _, apply := range []bool{false, true} {
+		d, err := NewGifDecoder(xmpSrc)
+		if err != nil {
+			t.Fatalf("NewGifDecoder failed: %v", err)
+		}
+		if _, err := ops.Transform(d, &GifOptions{
+			FileType:       ".gif",
+			Width:          16,
+			Height:         16,
+			ResizeMethod:   GifOpsResize,
+			ApplyXMPEdits:  apply,
+			ReturnManifest: true,
+		}, make([]byte, 1024*1024)); err != nil {
+			t.Fatalf("Transform failed: %v", err)
+		}
+		d.Close()
+
+		blob, err := ops.Manifest()
+		if err != nil {
+			t.Fatalf("Manifest failed: %v", err)
+		}
+		var got GifManifest
+		if err := json.Unmarshal(blob, &got); err != nil {
+			t.Fatalf("manifest is not valid JSON: %v", err)
+		}
+		if got.MetadataStripped != apply {
+			t.Errorf("applying edits %v: expected metadata_stripped %v, got %v", apply, apply, got.MetadataStripped)
+		}
+	}
+}
+
+func TestGifOpsScale(t *testing.T) {
+	src := newTestGif(t, []*image.Paletted{newTestGifFrame(32, 16, 2)}, 0)
+
+	tests := []struct {
+		name           string
+		scaleX, scaleY float64
+		width, height  int
+	}{
+		{"horizontal", 2, 1, 64, 16},
+		{"vertical only", 0, 0.5, 32, 8},
+		{"both", 0.5, 3, 16, 48},
+	}
+
+	for _, test := range tests {
+		out := transformTestGif(t, src, &GifOptions{
+			FileType: ".gif",
+			ScaleX:   test.scaleX,
+			ScaleY:   test.scaleY,
+		})
+		cfg, err := gif.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: failed to decode output: %v", test.name, err)
+		}
+		if cfg.Width != test.width || cfg.Height != test.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d", test.name, test.width, test.height, cfg.Width, cfg.Height)
+		}
+	}
+
+	for _, scale := range [][2]float64{{-1, 1}, {2, -0.5}} {
+		d, err := NewGifDecoder(src)
+		if err != nil {
+			t.Fatalf("NewGifDecoder failed: %v", err)
+		}
+		ops := NewGifOps(64)
+		_, err = ops.Transform(d, &GifOptions{FileType: ".gif", ScaleX: scale[0], ScaleY: scale[1]}, make([]byte, 1024*1024))
+		if err != ErrInvalidScale {
+			t.Errorf("scale %v: expected ErrInvalidScale, got %v", scale, err)
+		}
+		ops.Close()
+		d.Close()
+	}
+}
+
+func TestGifOpsOptimizeFrameBounds(t *testing.T) {
+	// a small blue square moving across a white background
+	square := func(i int) image.Rectangle {
+		return image.Rect(8*i, 20, 8*i+4, 24)
+	}
+	var frames []*image.Paletted
+	for i := 0; i < 4; i++ {
+		frame := newTestGifFrame(64, 64, 1)
+		r := square(i)
+		for y := r.Min.Y; y < r.Max.Y; y++ {
+			for x := r.Min.X; x < r.Max.X; x++ {
+				frame.SetColorIndex(x, y, 4)
+			}
+		}
+		frames = append(frames, frame)
+	}
+	src := newTestGif(t, frames, 10)
+
+	full := transformTestGif(t, src, &GifOptions{FileType: ".gif"})
+	// the input needs no other changes, so it must not be passed through
+	optimized := transformTestGif(t, src, &GifOptions{
+		FileType:             ".gif",
+		PassThroughOptimized: true,
+		EncodeOptions:        map[int]int{GifOptimizeFrameBounds: 1},
+	})
+	if len(optimized) >= len(full) {
+		t.Errorf("expected optimized output to be smaller than %d bytes, got %d", len(full), len(optimized))
+	}
+
+	g, err := gif.DecodeAll(bytes.NewReader(optimized))
+	if err != nil {
+		t.Fatalf("failed to read optimized GIF: %v", err)
+	}
+	if len(g.Image) != len(frames) {
+		t.Fatalf("expected %d frames, got %d", len(frames), len(g.Image))
+	}
+
+	canvas := image.NewRGBA(image.Rect(0, 0, 64, 64))
+	for i, frame := range g.Image {
+		if i > 0 {
+			changed := square(i - 1).Union(square(i))
+			if !frame.Bounds().In(changed) {
+				t.Errorf("frame %d: expected bounds within %v, got %v", i, changed, frame.Bounds())
+			}
+		}
+
+		// play the frame back over the previous ones
+		b := frame.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := color.RGBAModel.Convert(frame.At(x, y)).(color.RGBA); c.A != 0 {
+					canvas.SetRGBA(x, y, c)
+				}
+			}
+		}
+		for y := 0; y < 64; y++ {
+			for x := 0; x < 64; x++ {
+				expected := color.RGBAModel.Convert(frames[i].At(x, y)).(color.RGBA)
+				if got := canvas.RGBAAt(x, y); got != expected {
+					t.Fatalf("frame %d: pixel %d,%d expected %v, got %v", i, x, y, expected, got)
+				}
+			}
+		}
+	}
+}
+
+// playTestGif composites the frames of g as a viewer would, returning the
+// canvas shown for each frame
+func playTestGif(g *gif.GIF) []*image.RGBA {
+	canvas := image.NewRGBA(image.Rect(0, 0, g.Config.Width, g.Config.Height))
+	var shown []*image.RGBA
+	for i, frame := range g.Image {
+		b := frame.Bounds()
+		for y := b.Min.Y; y < b.Max.Y; y++ {
+			for x := b.Min.X; x < b.Max.X; x++ {
+				if c := color.RGBAModel.Convert(frame.At(x, y)).(color.RGBA); c.A != 0 {
+					canvas.SetRGBA(x, y, c)
+				}
+			}
+		}
+		shown = append(shown, image.NewRGBA(canvas.Bounds()))
+		copy(shown[i].Pix, canvas.Pix)
+
+		if g.Disposal[i] == gif.DisposalBackground {
+			for y := b.Min.Y; y < b.Max.Y; y++ {
+				for x := b.Min.X; x < b.Max.X; x++ {
+					canvas.SetRGBA(x, y, color.RGBA{})
+				}
+			}
+		}
+	}
+	return shown
+}
+
+func TestGifOpsOptimizeFrameBoundsDisposal(t *testing.T) {
+	// a white frame, the same with a blue square that is then cleared to the
+	// background, and a mostly transparent frame that shows the cleared canvas
+	first := newTestGifFrame(32, 32, 1)
+	second := newTestGifFrame(32, 32, 1)
+	third := newTestGifFrame(32, 32, 5)
+	for y := 8; y < 12; y++ {
+		for x := 8; x < 12; x++ {
+			second.SetColorIndex(x, y, 4)
+			third.SetColorIndex(x+12, y+12, 4)
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, &gif.GIF{
+		Image:    []*image.Paletted{first, second, third},
+		Delay:    []int{10, 10, 10},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalNone},
+	}); err != nil {
+		t.Fatalf("failed to build test GIF: %v", err)
+	}
+	src := buf.Bytes()
+
+	out := transformTestGif(t, src, &GifOptions{
+		FileType:      ".gif",
+		EncodeOptions: map[int]int{GifOptimizeFrameBounds: 1},
+	})
+
+	g, err := gif.DecodeAll(bytes.NewReader(out))
+	if err != nil {
+		t.Fatalf("failed to read optimized GIF: %v", err)
+	}
+	if len(g.Image) != 3 {
+		t.Fatalf("expected 3 frames, got %d", len(g.Image))
+	}
+	// clearing a cropped frame would leave the rest of the first frame behind
+	if b := g.Image[1].Bounds(); b != first.Bounds() {
+		t.Errorf("expected the background disposal frame to cover %v, got %v", first.Bounds(), b)
+	}
+
+	srcGif, err := gif.DecodeAll(bytes.NewReader(src))
+	if err != nil {
+		t.Fatalf("failed to read test GIF: %v", err)
+	}
+	expected := playTestGif(srcGif)
+	for i, shown := range playTestGif(g) {
+		for y := 0; y < 32; y++ {
+			for x := 0; x < 32; x++ {
+				if got, want := shown.RGBAAt(x, y), expected[i].RGBAAt(x, y); got != want {
+					t.Fatalf("frame %d: pixel %d,%d expected %v, got %v", i, x, y, want, got)
+				}
+			}
+		}
+	}
+}
+
+func TestGifOpsXMPEditsOutputSize(t *testing.T) {
+	// stored 100x200, displayed 200x100 once rotated clockwise
+	src := withTestGifXMP(newTestGif(t, []*image.Paletted{newTestGifFrame(100, 200, 2)}, 0),
+		`<rdf:Description tiff:Orientation="6"/>`)
+
+	tests := []struct {
+		name          string
+		opt           *GifOptions
+		width, height int
+	}{
+		{
+			"disable upscaling",
+			&GifOptions{Width: 200, Height: 100, ResizeMethod: GifOpsResize, DisableUpscaling: true},
+			200, 100,
+		},
+		{
+			"disable upscaling shrinks",
+			&GifOptions{Width: 400, Height: 100, ResizeMethod: GifOpsResize, DisableUpscaling: true},
+			200, 50,
+		},
+		{"scale", &GifOptions{ScaleX: 0.5, ScaleY: 1}, 100, 100},
+		{
+			"aspect distortion",
+			&GifOptions{Width: 100, Height: 50, ResizeMethod: GifOpsResize, MaxAspectDistortion: 1.01},
+			100, 50,
+		},
+	}
+
+	for _, test := range tests {
+		test.opt.FileType = ".gif"
+		test.opt.ApplyXMPEdits = true
+		out := transformTestGif(t, src, test.opt)
+		cfg, err := gif.DecodeConfig(bytes.NewReader(out))
+		if err != nil {
+			t.Fatalf("%s: failed to read transformed GIF: %v", test.name, err)
+		}
+		if cfg.Width != test.width || cfg.Height != test.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d", test.name, test.width, test.height, cfg.Width, cfg.Height)
+		}
+	}
+}
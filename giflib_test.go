@@ -0,0 +1,435 @@
+package gocv
+
+import (
+	"bytes"
+	"fmt"
+	"image"
+	"image/color"
+	"image/gif"
+	"math/rand"
+	"testing"
+	"time"
+)
+
+func TestGifDecoderFrameInfos(t *testing.T) {
+	g := &gif.GIF{
+		Image: []*image.Paletted{
+			newTestGifFrame(40, 30, 2),
+			image.NewPaletted(image.Rect(5, 10, 25, 20), testGifPalette),
+			image.NewPaletted(image.Rect(0, 0, 8, 4), testGifPalette),
+		},
+		Delay:    []int{10, 25, 0},
+		Disposal: []byte{gif.DisposalNone, gif.DisposalBackground, gif.DisposalPrevious},
+		Config:   image.Config{ColorModel: testGifPalette, Width: 40, Height: 30},
+	}
+	var buf bytes.Buffer
+	if err := gif.EncodeAll(&buf, g); err != nil {
+		t.Fatalf("failed to build test GIF: %v", err)
+	}
+
+	d, err := NewGifDecoder(buf.Bytes())
+	if err != nil {
+		t.Fatalf("NewGifDecoder failed: %v", err)
+	}
+	defer d.Close()
+
+	infos, err := d.FrameInfos()
+	if err != nil {
+		t.Fatalf("FrameInfos failed: %v", err)
+	}
+
+	expected := []GifFrameInfo{
+		{Left: 0, Top: 0, Width: 40, Height: 30, Delay: 100 * time.Millisecond, Disposal: GifDisposalNone},
+		{Left: 5, Top: 10, Width: 20, Height: 10, Delay: 250 * time.Millisecond, Disposal: GifDisposalBackground},
+		{Left: 0, Top: 0, Width: 8, Height: 4, Delay: 0, Disposal: GifDisposalPrevious},
+	}
+	if len(infos) != len(expected) {
+		t.Fatalf("expected %d frames, got %d", len(expected), len(infos))
+	}
+	for i := range expected {
+		if infos[i] != expected[i] {
+			t.Errorf("frame %d: expected %+v, got %+v", i, expected[i], infos[i])
+		}
+	}
+
+	// reading the frame layout must not disturb decoding
+	f := NewFramebuffer(40, 30)
+	defer f.Close()
+	if err := d.DecodeTo(f); err != nil {
+		t.Errorf("DecodeTo after FrameInfos failed: %v", err)
+	}
+}
+
+// newTestFramebuffer returns a BGRA Framebuffer with each pixel set by fill
+func newTestFramebuffer(t *testing.T, width, height int, fill func(x, y int) [4]byte) *Framebuffer {
+	f := NewFramebuffer(width, height)
+	if err := f.resizeMat(width, height, PixelType(MatTypeCV8UC4)); err != nil {
+		t.Fatalf("failed to size test Framebuffer: %v", err)
+	}
+	for y := 0; y < height; y++ {
+		for x := 0; x < width; x++ {
+			px := fill(x, y)
+			copy(f.buf[4*(y*width+x):], px[:])
+		}
+	}
+	return f
+}
+
+// testFramebufferPixel returns the BGRA value of the pixel at x, y
+func testFramebufferPixel(f *Framebuffer, x, y int) [4]byte {
+	var px [4]byte
+	copy(px[:], f.buf[4*(y*f.Width()+x):])
+	return px
+}
+
+func TestFramebufferCropCenterSquare(t *testing.T) {
+	coords := func(x, y int) [4]byte {
+		return [4]byte{byte(x), byte(y), 0, 255}
+	}
+
+	tests := []struct {
+		name          string
+		width, height int
+		left, top     int
+	}{
+		{"landscape", 30, 10, 10, 0},
+		{"portrait", 10, 30, 0, 10},
+		{"square", 12, 12, 0, 0},
+	}
+
+	for _, test := range tests {
+		src := newTestFramebuffer(t, test.width, test.height, coords)
+		dst := NewFramebuffer(test.width, test.height)
+
+		if err := src.CropCenterSquare(dst); err != nil {
+			t.Fatalf("%s: CropCenterSquare failed: %v", test.name, err)
+		}
+
+		size := test.width
+		if test.height < size {
+			size = test.height
+		}
+		if dst.Width() != size || dst.Height() != size {
+			t.Errorf("%s: expected %dx%d, got %dx%d", test.name, size, size, dst.Width(), dst.Height())
+		}
+
+		for _, p := range []image.Point{{0, 0}, {size - 1, size - 1}} {
+			expected := coords(p.X+test.left, p.Y+test.top)
+			if got := testFramebufferPixel(dst, p.X, p.Y); got != expected {
+				t.Errorf("%s: pixel %v expected %v, got %v", test.name, p, expected, got)
+			}
+		}
+
+		src.Close()
+		dst.Close()
+	}
+}
+
+func TestFramebufferFitDisplayAspect(t *testing.T) {
+	// a 720x480 NTSC frame with 8:9 pixels, left half red and right half blue
+	halves := func(x, y int) [4]byte {
+		if x < 360 {
+			return [4]byte{0, 0, 255, 255}
+		}
+		return [4]byte{255, 0, 0, 255}
+	}
+	src := newTestFramebuffer(t, 720, 480, halves)
+	defer src.Close()
+
+	tests := []struct {
+		name          string
+		displayAspect float64
+		height        int
+		width         int
+	}{
+		{"4:3", 4.0 / 3.0, 480, 640},
+		{"4:3 downscaled", 4.0 / 3.0, 240, 320},
+		{"16:9 crops height", 16.0 / 9.0, 360, 640},
+	}
+
+	for _, test := range tests {
+		dst := NewFramebuffer(720, 480)
+		if err := src.FitDisplayAspect(8.0/9.0, test.displayAspect, test.height, InterpolationNearestNeighbor, dst); err != nil {
+			t.Fatalf("%s: FitDisplayAspect failed: %v", test.name, err)
+		}
+		if dst.Width() != test.width || dst.Height() != test.height {
+			t.Errorf("%s: expected %dx%d, got %dx%d", test.name, test.width, test.height, dst.Width(), dst.Height())
+		}
+
+		// PAR correction squeezes the frame without moving the center
+		mid := dst.Width() / 2
+		if got := testFramebufferPixel(dst, mid-2, 0); got != halves(0, 0) {
+			t.Errorf("%s: expected red left of center, got %v", test.name, got)
+		}
+		if got := testFramebufferPixel(dst, mid+2, 0); got != halves(719, 0) {
+			t.Errorf("%s: expected blue right of center, got %v", test.name, got)
+		}
+		dst.Close()
+	}
+
+	dst := NewFramebuffer(720, 480)
+	defer dst.Close()
+	if err := src.FitDisplayAspect(0, 4.0/3.0, 480, InterpolationArea, dst); err != ErrInvalidAspectRatio {
+		t.Errorf("expected ErrInvalidAspectRatio for a zero pixel aspect, got %v", err)
+	}
+}
+
+func TestFramebufferResizeIntoBuffer(t *testing.T) {
+	src := newTestFramebuffer(t, 20, 10, func(x, y int) [4]byte {
+		return [4]byte{byte(10 * x), byte(20 * y), byte(x * y), 255}
+	})
+	defer src.Close()
+
+	expected := NewFramebuffer(7, 5)
+	defer expected.Close()
+	if err := src.ResizeToWithInterpolation(7, 5, InterpolationLinear, expected); err != nil {
+		t.Fatalf("ResizeToWithInterpolation failed: %v", err)
+	}
+
+	// pad each row out so the stride differs from the row length
+	const padding = 12
+	stride := 7*4 + padding
+	dst := bytes.Repeat([]byte{0xab}, 4*stride+7*4)
+	if err := src.ResizeIntoBuffer(7, 5, stride, InterpolationLinear, dst); err != nil {
+		t.Fatalf("ResizeIntoBuffer failed: %v", err)
+	}
+
+	for y := 0; y < 5; y++ {
+		row := dst[y*stride : y*stride+7*4]
+		if !bytes.Equal(row, expected.buf[y*7*4:(y+1)*7*4]) {
+			t.Errorf("row %d differs from ResizeTo: expected %v, got %v", y, expected.buf[y*7*4:(y+1)*7*4], row)
+		}
+		if y < 4 && !bytes.Equal(dst[y*stride+7*4:(y+1)*stride], bytes.Repeat([]byte{0xab}, padding)) {
+			t.Errorf("row %d padding was overwritten", y)
+		}
+	}
+
+	if err := src.ResizeIntoBuffer(7, 5, 7*4-1, InterpolationLinear, dst); err != ErrInvalidStride {
+		t.Errorf("expected ErrInvalidStride, got %v", err)
+	}
+	if err := src.ResizeIntoBuffer(7, 5, stride, InterpolationLinear, dst[:len(dst)-1]); err != ErrBufTooSmall {
+		t.Errorf("expected ErrBufTooSmall, got %v", err)
+	}
+}
+
+func TestInterpolationCostEstimate(t *testing.T) {
+	ordered := []InterpolationFlags{
+		InterpolationNearestNeighbor,
+		InterpolationLinear,
+		InterpolationCubic,
+		InterpolationLanczos4,
+	}
+	for i := 1; i < len(ordered); i++ {
+		prev, cur := InterpolationCostEstimate(ordered[i-1]), InterpolationCostEstimate(ordered[i])
+		if prev >= cur {
+			t.Errorf("expected %v (%d) to cost less than %v (%d)", ordered[i-1], prev, ordered[i], cur)
+		}
+	}
+
+	if cost := InterpolationCostEstimate(InterpolationArea); cost < 1 || cost >= InterpolationCostEstimate(InterpolationLanczos4) {
+		t.Errorf("expected area to rank between nearest neighbor and Lanczos, got %d", cost)
+	}
+	if cost := InterpolationCostEstimate(InterpolationMax); cost != 0 {
+		t.Errorf("expected 0 for an unknown interpolation, got %d", cost)
+	}
+}
+
+func BenchmarkFramebufferResize(b *testing.B) {
+	sizes := []struct {
+		name                string
+		srcWidth, srcHeight int
+		dstWidth, dstHeight int
+	}{
+		{"thumbnail", 1920, 1080, 256, 144},
+		{"half", 640, 480, 320, 240},
+		{"enlarge", 256, 256, 1024, 1024},
+	}
+	kernels := []InterpolationFlags{
+		InterpolationNearestNeighbor,
+		InterpolationLinear,
+		InterpolationArea,
+		InterpolationCubic,
+		InterpolationLanczos4,
+	}
+
+	for _, size := range sizes {
+		src := NewFramebuffer(size.srcWidth, size.srcHeight)
+		if err := src.resizeMat(size.srcWidth, size.srcHeight, PixelType(MatTypeCV8UC4)); err != nil {
+			b.Fatalf("failed to size source Framebuffer: %v", err)
+		}
+		rand.New(rand.NewSource(1)).Read(src.buf)
+		dst := NewFramebuffer(size.dstWidth, size.dstHeight)
+
+		for _, interp := range kernels {
+			b.Run(fmt.Sprintf("%s/%v", size.name, interp), func(b *testing.B) {
+				for i := 0; i < b.N; i++ {
+					if err := src.ResizeToWithInterpolation(size.dstWidth, size.dstHeight, interp, dst); err != nil {
+						b.Fatalf("ResizeToWithInterpolation failed: %v", err)
+					}
+				}
+			})
+		}
+
+		src.Close()
+		dst.Close()
+	}
+}
+
+func TestFramebufferTrim(t *testing.T) {
+	// a red 8x4 block at 5, 3 on a white border with a little color noise
+	// and one translucent pixel in the bottom left corner
+	content := image.Rect(5, 3, 13, 7)
+	src := newTestFramebuffer(t, 20, 12, func(x, y int) [4]byte {
+		if image.Pt(x, y).In(content) {
+			return [4]byte{0, 0, 255, 255}
+		}
+		noise := byte((x*7 + y*3) % 4)
+		alpha := byte(255)
+		if x == 0 && y == 11 {
+			alpha = 250
+		}
+		return [4]byte{255 - noise, 255, 255 - noise/2, alpha}
+	})
+	defer src.Close()
+
+	tests := []struct {
+		name     string
+		opt      TrimOptions
+		expected image.Rectangle
+	}{
+		{"per channel tolerance", TrimOptions{Tolerance: color.RGBA{R: 2, B: 3}}, content},
+		{"too tight for blue noise", TrimOptions{Tolerance: color.RGBA{R: 2, B: 1}}, image.Rect(0, 0, 20, 12)},
+		{"alpha included", TrimOptions{Tolerance: color.RGBA{R: 2, B: 3}, IncludeAlpha: true}, image.Rect(0, 3, 13, 12)},
+		{"alpha tolerance", TrimOptions{Tolerance: color.RGBA{R: 2, B: 3, A: 5}, IncludeAlpha: true}, content},
+	}
+
+	for _, test := range tests {
+		dst := NewFramebuffer(20, 12)
+		if err := src.Trim(test.opt, dst); err != nil {
+			t.Fatalf("%s: Trim failed: %v", test.name, err)
+		}
+		if dst.Width() != test.expected.Dx() || dst.Height() != test.expected.Dy() {
+			t.Errorf("%s: expected %dx%d, got %dx%d", test.name, test.expected.Dx(), test.expected.Dy(), dst.Width(), dst.Height())
+		} else {
+			corner := image.Pt(content.Min.X-test.expected.Min.X, content.Min.Y-test.expected.Min.Y)
+			if got := testFramebufferPixel(dst, corner.X, corner.Y); got != [4]byte{0, 0, 255, 255} {
+				t.Errorf("%s: expected red at %v, got %v", test.name, corner, got)
+			}
+		}
+		dst.Close()
+	}
+}
+
+func TestFramebufferSSIM(t *testing.T) {
+	gradient := func(x, y int) [4]byte {
+		return [4]byte{byte(4 * x), byte(4 * y), byte(2 * (x + y)), 255}
+	}
+	noisy := func(amount int) func(x, y int) [4]byte {
+		r := rand.New(rand.NewSource(1))
+		return func(x, y int) [4]byte {
+			px := gradient(x, y)
+			for i := 0; i < 3; i++ {
+				v := int(px[i]) + r.Intn(2*amount+1) - amount
+				if v < 0 {
+					v = 0
+				} else if v > 255 {
+					v = 255
+				}
+				px[i] = byte(v)
+			}
+			return px
+		}
+	}
+
+	src := newTestFramebuffer(t, 64, 64, gradient)
+	defer src.Close()
+	same := newTestFramebuffer(t, 64, 64, gradient)
+	defer same.Close()
+	light := newTestFramebuffer(t, 64, 64, noisy(8))
+	defer light.Close()
+	heavy := newTestFramebuffer(t, 64, 64, noisy(64))
+	defer heavy.Close()
+
+	if ssim := src.SSIM(same); !floatEquals(ssim, 1.0) {
+		t.Errorf("SSIM of identical buffers should be 1.0, got %v", ssim)
+	}
+
+	lightSSIM := src.SSIM(light)
+	heavySSIM := src.SSIM(heavy)
+	if lightSSIM >= 1.0 {
+		t.Errorf("SSIM with added noise should be below 1.0, got %v", lightSSIM)
+	}
+	if heavySSIM >= lightSSIM {
+		t.Errorf("SSIM should degrade with more noise, got %v for light and %v for heavy", lightSSIM, heavySSIM)
+	}
+
+	small := newTestFramebuffer(t, 32, 32, gradient)
+	defer small.Close()
+	if ssim := src.SSIM(small); ssim != 0 {
+		t.Errorf("SSIM of mismatched dimensions should be 0, got %v", ssim)
+	}
+}
+
+func TestWithBackendThreads(t *testing.T) {
+	prev := BackendThreads()
+
+	var during int
+	_, err := withBackendThreads(1, func() ([]byte, error) {
+		during = BackendThreads()
+		return nil, nil
+	})
+	if err != nil {
+		t.Fatalf("withBackendThreads failed: %v", err)
+	}
+
+	if during != 1 {
+		t.Errorf("expected 1 backend thread during the operation, got %d", during)
+	}
+	if after := BackendThreads(); after != prev {
+		t.Errorf("expected backend threads to be restored to %d, got %d", prev, after)
+	}
+}
+
+func TestWithBackendThreadsOverlapping(t *testing.T) {
+	prev := BackendThreads()
+
+	aEntered, aDone := make(chan struct{}), make(chan struct{})
+	bEntered, bRelease, bDone := make(chan struct{}), make(chan struct{}), make(chan struct{})
+	var bothCap, bAloneCap int
+
+	go func() {
+		defer close(aDone)
+		withBackendThreads(2, func() ([]byte, error) {
+			close(aEntered)
+			<-bEntered
+			bothCap = BackendThreads()
+			return nil, nil
+		})
+	}()
+
+	<-aEntered
+	go func() {
+		defer close(bDone)
+		withBackendThreads(3, func() ([]byte, error) {
+			close(bEntered)
+			<-bRelease
+			bAloneCap = BackendThreads()
+			return nil, nil
+		})
+	}()
+
+	// A returns while B is still running
+	<-aDone
+	close(bRelease)
+	<-bDone
+
+	if bothCap != 2 {
+		t.Errorf("expected the smallest cap of 2 while both run, got %d", bothCap)
+	}
+	if bAloneCap != 3 {
+		t.Errorf("expected B's cap of 3 after A returned, got %d", bAloneCap)
+	}
+	if after := BackendThreads(); after != prev {
+		t.Errorf("expected backend threads to be restored to %d, got %d", prev, after)
+	}
+}
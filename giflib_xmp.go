@@ -0,0 +1,134 @@
+package gocv
+
+import (
+	"bytes"
+	"image"
+	"regexp"
+	"strconv"
+)
+
+var (
+	gifXMPApplicationID      = []byte("XMP DataXMP")
+	gifNetscapeApplicationID = []byte("NETSCAPE2.0")
+
+	xmpOrientationRegexp = regexp.MustCompile(`tiff:Orientation(?:="|>)\s*([0-9]+)`)
+	xmpHasCropRegexp     = regexp.MustCompile(`crs:HasCrop(?:="|>)\s*(?i:true)`)
+	xmpCropRegexps       = map[string]*regexp.Regexp{}
+)
+
+func init() {
+	for _, edge := range []string{"Left", "Top", "Right", "Bottom"} {
+		xmpCropRegexps[edge] = regexp.MustCompile(`crs:Crop` + edge + `(?:="|>)\s*([0-9.]+)`)
+	}
+}
+
+// xmpEdits are the non-destructive edits an editor recorded in an image's
+// XMP packet
+type xmpEdits struct {
+	// orientation is how the stored pixels should be rotated for display
+	orientation ImageOrientation
+
+	// hasCrop is set when the crop fields are valid
+	hasCrop bool
+
+	// the crop edges, as fractions of the unrotated image's dimensions
+	cropLeft, cropTop, cropRight, cropBottom float64
+}
+
+// cropRect returns the crop as a pixel rectangle within a width x height
+// image. The rectangle is empty if there is no usable crop.
+func (e xmpEdits) cropRect(width, height int) image.Rectangle {
+	if !e.hasCrop {
+		return image.Rectangle{}
+	}
+
+	r := image.Rect(
+		int(e.cropLeft*float64(width)+0.5),
+		int(e.cropTop*float64(height)+0.5),
+		int(e.cropRight*float64(width)+0.5),
+		int(e.cropBottom*float64(height)+0.5),
+	)
+	r = r.Intersect(image.Rect(0, 0, width, height))
+	if r.Eq(image.Rect(0, 0, width, height)) {
+		return image.Rectangle{}
+	}
+	return r
+}
+
+// gifXMP returns the XMP packet embedded in the GIF in buf, or nil if there
+// is none. XMP is stored raw in an application extension, so the packet is
+// the extension's data with its sub-block framing left in place.
+func gifXMP(buf []byte) []byte {
+	var xmp []byte
+	walkGifBlocks(buf, func(block []byte) {
+		if xmp != nil || block[0] != gifExtensionIntroducer || block[1] != gifApplicationLabel {
+			return
+		}
+		if len(block) < 3+len(gifXMPApplicationID) || block[2] != byte(len(gifXMPApplicationID)) {
+			return
+		}
+		if !bytes.Equal(block[3:3+len(gifXMPApplicationID)], gifXMPApplicationID) {
+			return
+		}
+		xmp = block[3+len(gifXMPApplicationID):]
+	})
+	return xmp
+}
+
+// gifHasMetadata reports whether buf holds comment extensions or application
+// extensions other than the NETSCAPE2.0 looping extension
+func gifHasMetadata(buf []byte) bool {
+	found := false
+	walkGifBlocks(buf, func(block []byte) {
+		if found || block[0] != gifExtensionIntroducer {
+			return
+		}
+		switch block[1] {
+		case gifCommentLabel:
+			found = true
+		case gifApplicationLabel:
+			id := block[2:]
+			if len(id) > 0 && int(id[0]) < len(id) {
+				id = id[1 : 1+int(id[0])]
+			}
+			found = !bytes.Equal(id, gifNetscapeApplicationID)
+		}
+	})
+	return found
+}
+
+// parseXMPEdits extracts the orientation and Camera Raw crop settings from an
+// XMP packet. Crop angles are not supported and are ignored.
+func parseXMPEdits(xmp []byte) xmpEdits {
+	edits := xmpEdits{orientation: OrientationTopLeft}
+
+	if m := xmpOrientationRegexp.FindSubmatch(xmp); m != nil {
+		if v, err := strconv.Atoi(string(m[1])); err == nil && v >= int(OrientationTopLeft) && v <= int(OrientationLeftBottom) {
+			edits.orientation = ImageOrientation(v)
+		}
+	}
+
+	if !xmpHasCropRegexp.Match(xmp) {
+		return edits
+	}
+
+	edges := map[string]*float64{
+		"Left":   &edits.cropLeft,
+		"Top":    &edits.cropTop,
+		"Right":  &edits.cropRight,
+		"Bottom": &edits.cropBottom,
+	}
+	for edge, dst := range edges {
+		m := xmpCropRegexps[edge].FindSubmatch(xmp)
+		if m == nil {
+			return edits
+		}
+		v, err := strconv.ParseFloat(string(m[1]), 64)
+		if err != nil {
+			return edits
+		}
+		*dst = v
+	}
+	edits.hasCrop = edits.cropLeft < edits.cropRight && edits.cropTop < edits.cropBottom
+	return edits
+}